@@ -0,0 +1,314 @@
+package analytics
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ip812/blog/articles"
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtx"
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/middleware"
+)
+
+const (
+	queueSize     = 1024
+	batchSize     = 100
+	flushInterval = 10 * time.Second
+
+	articlesPrefix = "/p/public/articles/"
+)
+
+const (
+	UserAgentBot     = "bot"
+	UserAgentMobile  = "mobile"
+	UserAgentTablet  = "tablet"
+	UserAgentDesktop = "desktop"
+	UserAgentOther   = "other"
+)
+
+type DBProvider interface {
+	DB() (*sql.DB, error)
+}
+
+// view is a page view waiting to be written. The client address is kept in
+// memory only until the batch is flushed, where it is turned into a salted
+// hash and dropped.
+type view struct {
+	path           string
+	articleID      int64
+	referrerHost   string
+	userAgentClass string
+	ip             string
+	userAgent      string
+	viewedAt       time.Time
+}
+
+// Recorder collects page views without cookies and writes them to Postgres
+// in batches. Visitors are counted by a hash of their address and user agent
+// salted with a random value that changes every day, so a visitor can't be
+// followed from one day to the next.
+type Recorder struct {
+	db    DBProvider
+	log   logger.Logger
+	queue chan view
+
+	saltDay time.Time
+	salt    []byte
+}
+
+func New(db DBProvider, log logger.Logger) *Recorder {
+	return &Recorder{
+		db:    db,
+		log:   log,
+		queue: make(chan view, queueSize),
+	}
+}
+
+// Middleware records successful GET requests. Bots, clients that send
+// Do Not Track or Global Privacy Control, and article paths not matching a
+// known article are skipped, so made up URLs can't flood the dashboard. Visitors are told apart
+// by the address found by middleware.ClientIPMiddleware, which has to run
+// first, otherwise everyone behind the ingress counts as one visitor.
+func (rec *Recorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		if r.Method != http.MethodGet || sw.status != http.StatusOK {
+			return
+		}
+		if r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1" {
+			return
+		}
+
+		uaClass := ClassifyUserAgent(r.UserAgent())
+		if uaClass == UserAgentBot {
+			return
+		}
+
+		articleID := articleIDFromPath(r.URL.Path)
+		if articleID == 0 && strings.HasPrefix(r.URL.Path, articlesPrefix) {
+			return
+		}
+
+		v := view{
+			path:           r.URL.Path,
+			articleID:      articleID,
+			referrerHost:   referrerHost(r),
+			userAgentClass: uaClass,
+			ip:             middleware.ClientIP(r),
+			userAgent:      r.UserAgent(),
+			viewedAt:       time.Now().UTC(),
+		}
+
+		select {
+		case rec.queue <- v:
+		default:
+			rec.log.Warn("analytics queue is full, dropping page view for %s", v.path)
+		}
+	})
+}
+
+// Run writes queued page views until ctx is cancelled, flushing whatever is
+// left before it returns.
+func (rec *Recorder) Run(ctx context.Context) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]view, 0, batchSize)
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		if err := rec.write(ctx, batch); err != nil {
+			rec.log.Error("failed to write %d page views: %s", len(batch), err.Error())
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+		drain:
+			for {
+				select {
+				case v := <-rec.queue:
+					batch = append(batch, v)
+				default:
+					break drain
+				}
+			}
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			flush(shutdownCtx)
+			cancel()
+			return
+		case v := <-rec.queue:
+			batch = append(batch, v)
+			if len(batch) >= batchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		}
+	}
+}
+
+func (rec *Recorder) write(ctx context.Context, batch []view) error {
+	db, err := rec.db.DB()
+	if err != nil {
+		return err
+	}
+
+	queries := database.New(dbtx.Instrument(db))
+
+	params := database.CreatePageViewsParams{
+		Paths:            make([]string, 0, len(batch)),
+		ArticleIds:       make([]int64, 0, len(batch)),
+		ReferrerHosts:    make([]string, 0, len(batch)),
+		UserAgentClasses: make([]string, 0, len(batch)),
+		VisitorHashes:    make([][]byte, 0, len(batch)),
+		ViewedAts:        make([]int64, 0, len(batch)),
+	}
+	for _, v := range batch {
+		salt, err := rec.saltFor(ctx, queries, v.viewedAt)
+		if err != nil {
+			return err
+		}
+
+		params.Paths = append(params.Paths, v.path)
+		params.ArticleIds = append(params.ArticleIds, v.articleID)
+		params.ReferrerHosts = append(params.ReferrerHosts, v.referrerHost)
+		params.UserAgentClasses = append(params.UserAgentClasses, v.userAgentClass)
+		params.VisitorHashes = append(params.VisitorHashes, visitorHash(salt, v.ip, v.userAgent))
+		params.ViewedAts = append(params.ViewedAts, v.viewedAt.Unix())
+	}
+
+	return queries.CreatePageViews(ctx, params)
+}
+
+// saltFor returns the salt of the day t falls on. Salts are shared through
+// Postgres so every instance hashes a visitor the same way, and salts of
+// past days are deleted once a new day starts.
+func (rec *Recorder) saltFor(ctx context.Context, queries *database.Queries, t time.Time) ([]byte, error) {
+	day := t.Truncate(24 * time.Hour)
+	if rec.salt != nil && rec.saltDay.Equal(day) {
+		return rec.salt, nil
+	}
+
+	salt, err := queries.GetOrCreateAnalyticsSalt(ctx, database.GetOrCreateAnalyticsSaltParams{
+		Day:  day,
+		Salt: []byte(rand.Text()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := queries.DeleteAnalyticsSaltsBefore(ctx, day); err != nil {
+		return nil, err
+	}
+
+	rec.saltDay = day
+	rec.salt = salt
+	return salt, nil
+}
+
+func visitorHash(salt []byte, ip, userAgent string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte{0})
+	h.Write([]byte(ip))
+	h.Write([]byte{0})
+	h.Write([]byte(userAgent))
+	return h.Sum(nil)[:16]
+}
+
+// ClassifyUserAgent reduces a user agent to a coarse device class.
+func ClassifyUserAgent(ua string) string {
+	ua = strings.ToLower(ua)
+	switch {
+	case ua == "":
+		return UserAgentOther
+	case strings.Contains(ua, "bot"),
+		strings.Contains(ua, "crawl"),
+		strings.Contains(ua, "spider"),
+		strings.Contains(ua, "slurp"),
+		strings.Contains(ua, "curl"),
+		strings.Contains(ua, "wget"),
+		strings.Contains(ua, "python-requests"),
+		strings.Contains(ua, "go-http-client"),
+		strings.Contains(ua, "headless"):
+		return UserAgentBot
+	case strings.Contains(ua, "ipad"), strings.Contains(ua, "tablet"):
+		return UserAgentTablet
+	case strings.Contains(ua, "mobi"), strings.Contains(ua, "iphone"), strings.Contains(ua, "android"):
+		return UserAgentMobile
+	case strings.Contains(ua, "windows"),
+		strings.Contains(ua, "macintosh"),
+		strings.Contains(ua, "x11"),
+		strings.Contains(ua, "linux"):
+		return UserAgentDesktop
+	default:
+		return UserAgentOther
+	}
+}
+
+func articleIDFromPath(path string) int64 {
+	rest, ok := strings.CutPrefix(path, articlesPrefix)
+	if !ok {
+		return 0
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSuffix(rest, "/"), 10, 64)
+	if err != nil || articles.GetByID(id) == nil {
+		return 0
+	}
+
+	return int64(id)
+}
+
+// referrerHost returns the host of an external referrer. Internal navigation
+// is not a referral and is dropped.
+func referrerHost(r *http.Request) string {
+	ref := r.Referer()
+	if ref == "" {
+		return ""
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	reqHost, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		reqHost = r.Host
+	}
+	if host == strings.TrimPrefix(strings.ToLower(reqHost), "www.") {
+		return ""
+	}
+
+	return host
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,70 @@
+package analytics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/ip812/blog/articles"
+	"github.com/ip812/blog/config"
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/middleware"
+)
+
+func testLogger() logger.Logger {
+	cfg := &config.Config{}
+	cfg.Log.Level = "error"
+	return logger.New(cfg)
+}
+
+func TestMiddlewareTellsVisitorsBehindProxyApart(t *testing.T) {
+	rec := New(nil, testLogger())
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	h := middleware.ClientIPMiddleware(trusted)(rec.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	for _, client := range []string{"198.51.100.1", "198.51.100.2"} {
+		r := httptest.NewRequest(http.MethodGet, "/p/public/articles", nil)
+		r.RemoteAddr = "10.1.2.3:80"
+		r.Header.Set("X-Forwarded-For", client)
+		r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	if len(rec.queue) != 2 {
+		t.Fatalf("recorded %d views, want 2", len(rec.queue))
+	}
+	first, second := <-rec.queue, <-rec.queue
+	if first.ip != "198.51.100.1" || second.ip != "198.51.100.2" {
+		t.Errorf("recorded addresses %q and %q, want the forwarded ones", first.ip, second.ip)
+	}
+
+	salt := []byte("salt")
+	if bytes.Equal(visitorHash(salt, first.ip, first.userAgent), visitorHash(salt, second.ip, second.userAgent)) {
+		t.Error("expected the visitors to hash differently")
+	}
+}
+
+func TestMiddlewareSkipsUnknownArticles(t *testing.T) {
+	rec := New(nil, testLogger())
+	h := rec.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	known := fmt.Sprintf("/p/public/articles/%d", articles.DeferDeepDiveID)
+	for _, path := range []string{known, "/p/public/articles/1", "/p/public/articles/not-an-id", "/p/public/articles"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	if len(rec.queue) != 2 {
+		t.Fatalf("recorded %d views, want the known article and the list", len(rec.queue))
+	}
+	if v := <-rec.queue; v.path != known || v.articleID != int64(articles.DeferDeepDiveID) {
+		t.Errorf("recorded %q (%d), want %q", v.path, v.articleID, known)
+	}
+	if v := <-rec.queue; v.path != "/p/public/articles" {
+		t.Errorf("recorded %q, want the article list", v.path)
+	}
+}
@@ -10,6 +10,7 @@ type ArticleMetadata struct {
 	URL             string
 	Description     string
 	ReadTimeMinutes int
+	Tags            []string
 }
 
 var (
@@ -29,6 +30,7 @@ var Metadata = []ArticleMetadata{
 		Name:            "Write a production-ready Go systemd service",
 		Description:     "Build a Go application that follows best practices for implementing a reliable, production-ready systemd service.",
 		ReadTimeMinutes: 10,
+		Tags:            []string{"go", "systemd", "linux", "deployment"},
 	},
 	{
 		ID:              SelfManagedObservabilityStackID,
@@ -36,6 +38,7 @@ var Metadata = []ArticleMetadata{
 		Name:            "A Practical Observability Architecture for Go apps",
 		Description:     "Why I decided to manage my own observability stack and how I did it.",
 		ReadTimeMinutes: 10,
+		Tags:            []string{"go", "observability", "opentelemetry", "homelab"},
 	},
 	{
 		ID:              DeferDeepDiveID,
@@ -43,6 +46,7 @@ var Metadata = []ArticleMetadata{
 		Name:            "Defer in Go: Deep Dive",
 		Description:     "How defer works in Go, common pitfalls and best practices.",
 		ReadTimeMinutes: 8,
+		Tags:            []string{"go", "internals"},
 	},
 	{
 		ID:              AnsiblePlusTailsclaleEqualGreatComboID,
@@ -50,6 +54,7 @@ var Metadata = []ArticleMetadata{
 		Name:            "Ansible + Tailscale = 🎉 ",
 		Description:     "Manage VMs in a private network with Ansible and Tailscale.",
 		ReadTimeMinutes: 4,
+		Tags:            []string{"ansible", "tailscale", "networking", "homelab"},
 	},
 	{
 		ID:              ZeroTrustHomelabV2ID,
@@ -57,6 +62,7 @@ var Metadata = []ArticleMetadata{
 		Name:            "Zero trust homelab V2",
 		Description:     "An updated version of my homelab setup using FluxCD, Doppler and my own Terraform provider.",
 		ReadTimeMinutes: 6,
+		Tags:            []string{"homelab", "kubernetes", "terraform", "gitops", "zero-trust"},
 	},
 	{
 		ID:              ZeroTrustHomelabID,
@@ -64,6 +70,7 @@ var Metadata = []ArticleMetadata{
 		Name:            "Zero trust homelab",
 		Description:     "My homelab setup using Terraform, Helm, Cloudflare, Tailscale and more...",
 		ReadTimeMinutes: 9,
+		Tags:            []string{"homelab", "kubernetes", "terraform", "cloudflare", "tailscale", "zero-trust"},
 	},
 }
 
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrAdminDisabled = errors.New("admin login is not configured")
+
+// Credentials checks the admin login form. The password and the TOTP code are
+// each required when configured, so either one alone or both together can
+// protect the admin area.
+type Credentials struct {
+	passwordHash string
+	totp         *TOTP
+}
+
+func NewCredentials(passwordHash, totpSecret string) (*Credentials, error) {
+	c := &Credentials{passwordHash: passwordHash}
+
+	if passwordHash != "" {
+		if _, err := VerifyPassword(passwordHash, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	if totpSecret != "" {
+		t, err := NewTOTP(totpSecret)
+		if err != nil {
+			return nil, err
+		}
+		c.totp = t
+	}
+
+	if c.passwordHash == "" && c.totp == nil {
+		return nil, ErrAdminDisabled
+	}
+
+	return c, nil
+}
+
+func (c *Credentials) RequiresPassword() bool {
+	return c.passwordHash != ""
+}
+
+func (c *Credentials) RequiresTOTP() bool {
+	return c.totp != nil
+}
+
+func (c *Credentials) Check(password, code string) bool {
+	if c.RequiresPassword() {
+		ok, err := VerifyPassword(c.passwordHash, password)
+		if err != nil || !ok {
+			return false
+		}
+	}
+
+	if c.RequiresTOTP() && !c.totp.Validate(code, time.Now()) {
+		return false
+	}
+
+	return true
+}
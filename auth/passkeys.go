@@ -0,0 +1,321 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtx"
+)
+
+const (
+	ceremonyTTL = 5 * time.Minute
+	// login ceremonies can be started without a session, so the number
+	// pending at once is capped to keep the table small
+	maxPendingCeremonies = 32
+)
+
+var (
+	ErrCeremonyExpired   = errors.New("passkey ceremony expired, please try again")
+	ErrNoPasskeys        = errors.New("no passkeys are registered")
+	ErrTooManyCeremonies = errors.New("too many passkey ceremonies in progress, try again later")
+)
+
+// adminUser is the only WebAuthn user of the blog.
+type adminUser struct {
+	credentials []webauthn.Credential
+}
+
+func (u *adminUser) WebAuthnID() []byte                         { return []byte("admin") }
+func (u *adminUser) WebAuthnName() string                       { return "admin" }
+func (u *adminUser) WebAuthnDisplayName() string                { return "Admin" }
+func (u *adminUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+type Passkey struct {
+	ID         []byte
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// Passkeys runs the WebAuthn registration and login ceremonies for the admin.
+// Ceremony state is kept in Postgres and can be finished only once. Begin and
+// finish calls exchange plain JSON, so any authenticator that speaks the
+// WebAuthn wire format, including a software one, can drive them.
+type Passkeys struct {
+	db DBProvider
+	wa *webauthn.WebAuthn
+}
+
+func NewPasskeys(db DBProvider, rpID, rpOrigin string) (*Passkeys, error) {
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: "Ilia's blog",
+		RPOrigins:     []string{rpOrigin},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Passkeys{
+		db: db,
+		wa: wa,
+	}, nil
+}
+
+func (p *Passkeys) BeginRegistration(ctx context.Context) (*protocol.CredentialCreation, string, error) {
+	user, err := p.user(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	creation, session, err := p.wa.BeginRegistration(
+		user,
+		webauthn.WithExclusions(webauthn.Credentials(user.credentials).CredentialDescriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	id, err := p.saveCeremony(ctx, session)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return creation, id, nil
+}
+
+func (p *Passkeys) FinishRegistration(ctx context.Context, ceremonyID string, name string, body io.Reader) error {
+	session, err := p.takeCeremony(ctx, ceremonyID)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(body)
+	if err != nil {
+		return err
+	}
+
+	user, err := p.user(ctx)
+	if err != nil {
+		return err
+	}
+
+	cred, err := p.wa.CreateCredential(user, *session, parsed)
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+
+	db, err := p.db.DB()
+	if err != nil {
+		return err
+	}
+
+	return database.New(dbtx.Instrument(db)).CreateAdminWebAuthnCredential(ctx, database.CreateAdminWebAuthnCredentialParams{
+		ID:         cred.ID,
+		Name:       name,
+		Credential: raw,
+	})
+}
+
+func (p *Passkeys) BeginLogin(ctx context.Context) (*protocol.CredentialAssertion, string, error) {
+	user, err := p.user(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(user.credentials) == 0 {
+		return nil, "", ErrNoPasskeys
+	}
+
+	assertion, session, err := p.wa.BeginLogin(user)
+	if err != nil {
+		return nil, "", err
+	}
+
+	id, err := p.saveCeremony(ctx, session)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return assertion, id, nil
+}
+
+func (p *Passkeys) FinishLogin(ctx context.Context, ceremonyID string, body io.Reader) error {
+	session, err := p.takeCeremony(ctx, ceremonyID)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(body)
+	if err != nil {
+		return err
+	}
+
+	user, err := p.user(ctx)
+	if err != nil {
+		return err
+	}
+
+	cred, err := p.wa.ValidateLogin(user, *session, parsed)
+	if err != nil {
+		return err
+	}
+	if cred.Authenticator.CloneWarning {
+		return fmt.Errorf("passkey %x may have been cloned", cred.ID)
+	}
+
+	raw, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+
+	db, err := p.db.DB()
+	if err != nil {
+		return err
+	}
+
+	return database.New(dbtx.Instrument(db)).UpdateAdminWebAuthnCredentialUsage(ctx, database.UpdateAdminWebAuthnCredentialUsageParams{
+		ID:         cred.ID,
+		Credential: raw,
+	})
+}
+
+func (p *Passkeys) List(ctx context.Context) ([]Passkey, error) {
+	db, err := p.db.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := database.New(dbtx.Instrument(db)).GetAllAdminWebAuthnCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys := make([]Passkey, 0, len(rows))
+	for _, row := range rows {
+		pk := Passkey{
+			ID:        row.ID,
+			Name:      row.Name,
+			CreatedAt: row.CreatedAt,
+		}
+		if row.LastUsedAt.Valid {
+			pk.LastUsedAt = &row.LastUsedAt.Time
+		}
+		passkeys = append(passkeys, pk)
+	}
+
+	return passkeys, nil
+}
+
+func (p *Passkeys) Count(ctx context.Context) (int64, error) {
+	db, err := p.db.DB()
+	if err != nil {
+		return 0, err
+	}
+
+	return database.New(dbtx.Instrument(db)).CountAdminWebAuthnCredentials(ctx)
+}
+
+func (p *Passkeys) Delete(ctx context.Context, id []byte) error {
+	db, err := p.db.DB()
+	if err != nil {
+		return err
+	}
+
+	return database.New(dbtx.Instrument(db)).DeleteAdminWebAuthnCredential(ctx, id)
+}
+
+func (p *Passkeys) user(ctx context.Context) (*adminUser, error) {
+	db, err := p.db.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := database.New(dbtx.Instrument(db)).GetAllAdminWebAuthnCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &adminUser{}
+	for _, row := range rows {
+		var cred webauthn.Credential
+		if err := json.Unmarshal(row.Credential, &cred); err != nil {
+			return nil, fmt.Errorf("failed to decode passkey %x: %w", row.ID, err)
+		}
+		user.credentials = append(user.credentials, cred)
+	}
+
+	return user, nil
+}
+
+func (p *Passkeys) saveCeremony(ctx context.Context, session *webauthn.SessionData) (string, error) {
+	raw, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	db, err := p.db.DB()
+	if err != nil {
+		return "", err
+	}
+
+	queries := database.New(dbtx.Instrument(db))
+	if _, err := queries.DeleteExpiredAdminWebAuthnCeremonies(ctx); err != nil {
+		return "", err
+	}
+	pending, err := queries.CountAdminWebAuthnCeremonies(ctx)
+	if err != nil {
+		return "", err
+	}
+	if pending >= maxPendingCeremonies {
+		return "", ErrTooManyCeremonies
+	}
+
+	id := rand.Text()
+	err = queries.CreateAdminWebAuthnCeremony(ctx, database.CreateAdminWebAuthnCeremonyParams{
+		ID:          hashToken(id),
+		SessionData: raw,
+		ExpiresAt:   time.Now().UTC().Add(ceremonyTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+func (p *Passkeys) takeCeremony(ctx context.Context, id string) (*webauthn.SessionData, error) {
+	db, err := p.db.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := database.New(dbtx.Instrument(db)).TakeAdminWebAuthnCeremony(ctx, hashToken(id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCeremonyExpired
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal(raw, &session); err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/ip812/blog/dbtest"
+)
+
+const (
+	testRPID     = "localhost"
+	testRPOrigin = "http://localhost:8080"
+)
+
+// authenticator flags, see https://www.w3.org/TR/webauthn-3/#authdata-flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+// softAuthenticator is a passkey kept in memory. It answers the JSON sent by
+// the begin calls the way navigator.credentials does in the browser, see
+// static/js/webauthn.js.
+type softAuthenticator struct {
+	origin    string
+	id        []byte
+	key       *ecdsa.PrivateKey
+	signCount uint32
+}
+
+func newSoftAuthenticator(t *testing.T, origin string) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return &softAuthenticator{
+		origin: origin,
+		id:     id,
+		key:    key,
+	}
+}
+
+// create answers a registration ceremony with a "none" attestation.
+func (a *softAuthenticator) create(t *testing.T, creation *protocol.CredentialCreation) []byte {
+	t.Helper()
+
+	clientData := a.clientData(t, "webauthn.create", creation.Response.Challenge)
+
+	pub, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authData := a.authData(creation.Response.RelyingParty.ID, flagUserPresent|flagUserVerified|flagAttestedData)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.id)))
+	authData = append(authData, a.id...)
+	authData = append(authData, pub...)
+
+	attestation, err := webauthncbor.Marshal(struct {
+		Format    string         `cbor:"fmt"`
+		Statement map[string]any `cbor:"attStmt"`
+		AuthData  []byte         `cbor:"authData"`
+	}{
+		Format:    "none",
+		Statement: map[string]any{},
+		AuthData:  authData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.response(t, map[string]any{
+		"clientDataJSON":    b64(clientData),
+		"attestationObject": b64(attestation),
+		"transports":        []string{"internal"},
+	})
+}
+
+// get answers a login ceremony, signing with the key made by create.
+func (a *softAuthenticator) get(t *testing.T, assertion *protocol.CredentialAssertion) []byte {
+	t.Helper()
+
+	clientData := a.clientData(t, "webauthn.get", assertion.Response.Challenge)
+
+	a.signCount++
+	authData := a.authData(assertion.Response.RelyingPartyID, flagUserPresent|flagUserVerified)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(bytes.Clone(authData), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.response(t, map[string]any{
+		"clientDataJSON":    b64(clientData),
+		"authenticatorData": b64(authData),
+		"signature":         b64(signature),
+		"userHandle":        b64([]byte("admin")),
+	})
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, ceremony string, challenge protocol.URLEncodedBase64) []byte {
+	t.Helper()
+
+	raw, err := json.Marshal(map[string]any{
+		"type":        ceremony,
+		"challenge":   b64(challenge),
+		"origin":      a.origin,
+		"crossOrigin": false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func (a *softAuthenticator) authData(rpID string, flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, a.signCount)
+}
+
+func (a *softAuthenticator) response(t *testing.T, response map[string]any) []byte {
+	t.Helper()
+
+	raw, err := json.Marshal(map[string]any{
+		"id":       b64(a.id),
+		"rawId":    b64(a.id),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+type staticDB struct {
+	db *sql.DB
+}
+
+func (s staticDB) DB() (*sql.DB, error) {
+	return s.db, nil
+}
+
+// TestSoftAuthenticator runs both ceremonies against the relying party
+// config of NewPasskeys without storing anything, so the authenticator used
+// by the end to end test below is checked even without a database.
+func TestSoftAuthenticator(t *testing.T) {
+	p, err := NewPasskeys(nil, testRPID, testRPOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newSoftAuthenticator(t, testRPOrigin)
+	user := &adminUser{}
+
+	creation, session, err := p.wa.BeginRegistration(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedCreation, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(a.create(t, creation)))
+	if err != nil {
+		t.Fatalf("failed to parse the registration: %s", err)
+	}
+	cred, err := p.wa.CreateCredential(user, *session, parsedCreation)
+	if err != nil {
+		t.Fatalf("failed to register: %s", err)
+	}
+	user.credentials = append(user.credentials, *cred)
+
+	for range 2 {
+		assertion, session, err := p.wa.BeginLogin(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(a.get(t, assertion)))
+		if err != nil {
+			t.Fatalf("failed to parse the login: %s", err)
+		}
+		cred, err := p.wa.ValidateLogin(user, *session, parsed)
+		if err != nil {
+			t.Fatalf("failed to log in: %s", err)
+		}
+		user.credentials = []webauthn.Credential{*cred}
+	}
+
+	// an authenticator of another origin must not be accepted
+	phisher := newSoftAuthenticator(t, "https://blog.example.com")
+	phisher.id, phisher.key = a.id, a.key
+	assertion, session, err := p.wa.BeginLogin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(phisher.get(t, assertion)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.wa.ValidateLogin(user, *session, parsed); err == nil {
+		t.Error("expected a login from another origin to fail")
+	}
+}
+
+func TestPasskeyLoginEndToEnd(t *testing.T) {
+	db := dbtest.Open(t)
+	dbtest.Truncate(t, db, "admin_webauthn_credentials", "admin_webauthn_ceremonies", "admin_recovery_codes")
+
+	ctx := context.Background()
+	p, err := NewPasskeys(staticDB{db}, testRPID, testRPOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newSoftAuthenticator(t, testRPOrigin)
+
+	if _, _, err := p.BeginLogin(ctx); !errors.Is(err, ErrNoPasskeys) {
+		t.Fatalf("BeginLogin without passkeys = %v, want ErrNoPasskeys", err)
+	}
+
+	creation, ceremonyID, err := p.BeginRegistration(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.FinishRegistration(ctx, ceremonyID, "software", bytes.NewReader(a.create(t, creation))); err != nil {
+		t.Fatalf("failed to register: %s", err)
+	}
+
+	assertion, ceremonyID, err := p.BeginLogin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := a.get(t, assertion)
+	if err := p.FinishLogin(ctx, ceremonyID, bytes.NewReader(body)); err != nil {
+		t.Fatalf("failed to log in: %s", err)
+	}
+	if err := p.FinishLogin(ctx, ceremonyID, bytes.NewReader(body)); !errors.Is(err, ErrCeremonyExpired) {
+		t.Errorf("replaying the login = %v, want ErrCeremonyExpired", err)
+	}
+
+	passkeys, err := p.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passkeys) != 1 || passkeys[0].Name != "software" || passkeys[0].LastUsedAt == nil {
+		t.Errorf("passkeys = %+v, want the used software passkey", passkeys)
+	}
+
+	rc := NewRecoveryCodes(staticDB{db})
+	codes, err := rc.Generate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := rc.Use(ctx, "not-a-code"); err != nil || ok {
+		t.Errorf("Use(invalid) = %t, %v, want false", ok, err)
+	}
+	if ok, err := rc.Use(ctx, codes[0]); err != nil || !ok {
+		t.Errorf("Use(code) = %t, %v, want true", ok, err)
+	}
+	if ok, err := rc.Use(ctx, codes[0]); err != nil || ok {
+		t.Errorf("using a code twice = %t, %v, want false", ok, err)
+	}
+	if remaining, err := rc.Remaining(ctx); err != nil || remaining != recoveryCodeCount-1 {
+		t.Errorf("Remaining = %d, %v, want %d", remaining, err, recoveryCodeCount-1)
+	}
+}
+
+func TestPasskeyCeremoniesAreCapped(t *testing.T) {
+	db := dbtest.Open(t)
+	dbtest.Truncate(t, db, "admin_webauthn_credentials", "admin_webauthn_ceremonies")
+
+	ctx := context.Background()
+	p, err := NewPasskeys(staticDB{db}, testRPID, testRPOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range maxPendingCeremonies {
+		if _, _, err := p.BeginRegistration(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := p.BeginRegistration(ctx); !errors.Is(err, ErrTooManyCeremonies) {
+		t.Errorf("BeginRegistration past the cap = %v, want ErrTooManyCeremonies", err)
+	}
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtx"
+)
+
+const recoveryCodeCount = 10
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// RecoveryCodes are single-use fallbacks for when no passkey is at hand. Only
+// their hashes are stored; the codes are shown once when generated.
+type RecoveryCodes struct {
+	db DBProvider
+}
+
+func NewRecoveryCodes(db DBProvider) *RecoveryCodes {
+	return &RecoveryCodes{db: db}
+}
+
+// Generate replaces all existing codes with a fresh set.
+func (rc *RecoveryCodes) Generate(ctx context.Context) ([]string, error) {
+	db, err := rc.db.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	queries := database.New(dbtx.Instrument(tx))
+
+	if err := queries.DeleteAllAdminRecoveryCodes(ctx); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		raw := make([]byte, 10)
+		rand.Read(raw)
+		enc := strings.ToLower(recoveryEncoding.EncodeToString(raw))
+		code := enc[:8] + "-" + enc[8:]
+
+		if err := queries.CreateAdminRecoveryCode(ctx, hashToken(normalizeRecoveryCode(code))); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Use burns the code and reports whether it was valid and unused.
+func (rc *RecoveryCodes) Use(ctx context.Context, code string) (bool, error) {
+	db, err := rc.db.DB()
+	if err != nil {
+		return false, err
+	}
+
+	n, err := database.New(dbtx.Instrument(db)).UseAdminRecoveryCode(ctx, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (rc *RecoveryCodes) Remaining(ctx context.Context) (int64, error) {
+	db, err := rc.db.DB()
+	if err != nil {
+		return 0, err
+	}
+
+	return database.New(dbtx.Instrument(db)).CountUnusedAdminRecoveryCodes(ctx)
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtx"
+)
+
+const (
+	SessionCookieName = "IP812_BLOG_ADMIN_SESSION"
+
+	sessionTTL         = 12 * time.Hour
+	sessionRotateAfter = 15 * time.Minute
+	// a rotated token stays valid briefly so requests already in flight
+	// with the old cookie are not logged out
+	sessionRotateGrace = 30 * time.Second
+)
+
+var ErrNoSession = errors.New("no valid admin session")
+
+type DBProvider interface {
+	DB() (*sql.DB, error)
+}
+
+type Sessions struct {
+	db     DBProvider
+	secure bool
+}
+
+func NewSessions(db DBProvider, secure bool) *Sessions {
+	return &Sessions{
+		db:     db,
+		secure: secure,
+	}
+}
+
+// Create starts a new session and sets its cookie. It must be called after a
+// successful login only, never reusing a token the client already had.
+func (s *Sessions) Create(ctx context.Context, w http.ResponseWriter) error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	queries := database.New(dbtx.Instrument(db))
+	if _, err := queries.DeleteExpiredAdminSessions(ctx); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	return s.issue(ctx, queries, w, now, now.Add(sessionTTL))
+}
+
+// Validate checks the session cookie and rotates the token once it gets
+// older than sessionRotateAfter. The absolute expiry is kept on rotation.
+func (s *Sessions) Validate(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	c, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return ErrNoSession
+	}
+
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := database.New(dbtx.Instrument(tx))
+
+	sess, err := queries.GetAdminSession(ctx, hashToken(c.Value))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNoSession
+	}
+	if err != nil {
+		return err
+	}
+
+	if time.Since(sess.RotatedAt) < sessionRotateAfter {
+		return nil
+	}
+
+	err = queries.ExpireAdminSession(ctx, database.ExpireAdminSessionParams{
+		TokenHash: sess.TokenHash,
+		ExpiresAt: time.Now().UTC().Add(sessionRotateGrace),
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.issue(ctx, queries, w, sess.CreatedAt, sess.ExpiresAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Sessions) Destroy(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	s.clearCookie(w)
+
+	c, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return nil
+	}
+
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	return database.New(dbtx.Instrument(db)).DeleteAdminSession(ctx, hashToken(c.Value))
+}
+
+func (s *Sessions) issue(ctx context.Context, queries *database.Queries, w http.ResponseWriter, createdAt, expiresAt time.Time) error {
+	token := rand.Text()
+
+	err := queries.CreateAdminSession(ctx, database.CreateAdminSessionParams{
+		TokenHash: hashToken(token),
+		CreatedAt: createdAt,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    token,
+		Path:     "/admin",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return nil
+}
+
+func (s *Sessions) clearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/admin",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// Throttle blocks a key after too many failed attempts within a window.
+type Throttle struct {
+	maxFailures int
+	window      time.Duration
+
+	mu        sync.Mutex
+	failures  map[string][]time.Time
+	lastSweep time.Time
+}
+
+func NewThrottle(maxFailures int, window time.Duration) *Throttle {
+	return &Throttle{
+		maxFailures: maxFailures,
+		window:      window,
+		failures:    map[string][]time.Time{},
+		lastSweep:   time.Now(),
+	}
+}
+
+func (t *Throttle) Allowed(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.recent(key)) < t.maxFailures
+}
+
+func (t *Throttle) Fail(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures[key] = append(t.recent(key), time.Now())
+	t.sweep()
+}
+
+func (t *Throttle) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, key)
+}
+
+// sweep drops the keys without recent failures once per window, so keys
+// that are never tried again don't pile up.
+func (t *Throttle) sweep() {
+	if time.Since(t.lastSweep) < t.window {
+		return
+	}
+	t.lastSweep = time.Now()
+	for key := range t.failures {
+		t.recent(key)
+	}
+}
+
+func (t *Throttle) recent(key string) []time.Time {
+	cutoff := time.Now().Add(-t.window)
+	kept := t.failures[key][:0]
+	for _, f := range t.failures[key] {
+		if f.After(cutoff) {
+			kept = append(kept, f)
+		}
+	}
+	if len(kept) == 0 {
+		delete(t.failures, key)
+		return nil
+	}
+	t.failures[key] = kept
+	return kept
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	th := NewThrottle(2, time.Hour)
+
+	th.Fail("a")
+	if !th.Allowed("a") {
+		t.Fatal("expected a key below the limit to be allowed")
+	}
+	th.Fail("a")
+	if th.Allowed("a") {
+		t.Fatal("expected a key at the limit to be blocked")
+	}
+	if !th.Allowed("b") {
+		t.Fatal("expected other keys to be allowed")
+	}
+
+	th.Reset("a")
+	if !th.Allowed("a") {
+		t.Fatal("expected a reset key to be allowed")
+	}
+}
+
+func TestThrottleSweepsStaleKeys(t *testing.T) {
+	th := NewThrottle(5, time.Minute)
+
+	th.Fail("stale")
+	th.failures["stale"][0] = time.Now().Add(-2 * time.Minute)
+	th.lastSweep = time.Now().Add(-2 * time.Minute)
+
+	th.Fail("fresh")
+
+	if _, ok := th.failures["stale"]; ok {
+		t.Error("expected the stale key to be swept")
+	}
+	if _, ok := th.failures["fresh"]; !ok {
+		t.Error("expected the fresh key to be kept")
+	}
+}
@@ -0,0 +1,238 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	format = "ip812-blog-export"
+	// Version is bumped whenever the layout of an archive changes, the
+	// schema of the tables is tracked separately by SchemaVersion.
+	Version = 1
+)
+
+var columnPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+type table struct {
+	name    string
+	orderBy string
+	// serial tables get their sequence moved past the restored IDs
+	serial bool
+	// adminCredentials tables are only exported when asked for, see Options
+	adminCredentials bool
+}
+
+// tables are exported in this order and restored in the same one. Admin
+// sessions and WebAuthn ceremonies are short-lived and left out.
+var tables = []table{
+	{name: "comments", orderBy: "id"},
+	{name: "comment_subscriptions", orderBy: "id"},
+	{name: "subscribers", orderBy: "id"},
+	{name: "newsletter_announcements", orderBy: "article_id"},
+	{name: "outbox_events", orderBy: "id"},
+	{name: "outbox_deliveries", orderBy: "event_id"},
+	{name: "page_views", orderBy: "id", serial: true},
+	{name: "analytics_salts", orderBy: "day"},
+	{name: "admin_webauthn_credentials", orderBy: "id", adminCredentials: true},
+	{name: "admin_recovery_codes", orderBy: "code_hash", adminCredentials: true},
+}
+
+// Options changes what Export writes.
+type Options struct {
+	// IncludeAdminCredentials adds the passkeys and recovery codes of the
+	// admin. Archives are plain text, so these would let whoever reads the
+	// archive in, only set it for archives kept as safe as the database.
+	IncludeAdminCredentials bool
+}
+
+// Header is the first line of an archive.
+type Header struct {
+	Format        string    `json:"format"`
+	Version       int       `json:"version"`
+	SchemaVersion int64     `json:"schema_version"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Record is every line of an archive after the header, one per row.
+type Record struct {
+	Table string          `json:"table"`
+	Row   json.RawMessage `json:"row"`
+}
+
+// Counts is the number of rows per table.
+type Counts map[string]int
+
+// Export writes every row of the exported tables to w as JSON Lines, in one
+// transaction so the archive is consistent. schemaVersion is the version of
+// the last applied migration.
+func Export(ctx context.Context, db *sql.DB, schemaVersion int64, w io.Writer, opts Options) (Counts, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	err = enc.Encode(Header{
+		Format:        format,
+		Version:       Version,
+		SchemaVersion: schemaVersion,
+		CreatedAt:     time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := Counts{}
+	for _, t := range tables {
+		if t.adminCredentials && !opts.IncludeAdminCredentials {
+			continue
+		}
+		n, err := exportTable(ctx, tx, enc, t)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export %s: %w", t.name, err)
+		}
+		counts[t.name] = n
+	}
+
+	return counts, bw.Flush()
+}
+
+func exportTable(ctx context.Context, tx *sql.Tx, enc *json.Encoder, t table) (int, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(
+		"SELECT row_to_json(t)::text FROM %s t ORDER BY %s",
+		pq.QuoteIdentifier(t.name),
+		pq.QuoteIdentifier(t.orderBy),
+	))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int
+	for rows.Next() {
+		var row []byte
+		if err := rows.Scan(&row); err != nil {
+			return 0, err
+		}
+		if err := enc.Encode(Record{Table: t.name, Row: row}); err != nil {
+			return 0, err
+		}
+		n++
+	}
+
+	return n, rows.Err()
+}
+
+// Import restores an archive written by Export in one transaction. Rows
+// whose key already exists are skipped, so an archive can be imported into
+// a database that already holds some of its rows, or imported twice.
+// Returns the number of rows inserted per table.
+func Import(ctx context.Context, db *sql.DB, schemaVersion int64, r io.Reader) (Counts, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var header Header
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("failed to read the archive header: %w", err)
+	}
+	if header.Format != format {
+		return nil, fmt.Errorf("not a blog archive")
+	}
+	if header.Version != Version {
+		return nil, fmt.Errorf("unsupported archive version %d", header.Version)
+	}
+	if header.SchemaVersion > schemaVersion {
+		return nil, fmt.Errorf("archive is from schema version %d, the database is at %d, run `main migrate up` first", header.SchemaVersion, schemaVersion)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	counts := Counts{}
+	for {
+		var rec Record
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the archive: %w", err)
+		}
+
+		i := slices.IndexFunc(tables, func(t table) bool { return t.name == rec.Table })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown table %q in the archive", rec.Table)
+		}
+
+		inserted, err := importRow(ctx, tx, rec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to import into %s: %w", rec.Table, err)
+		}
+		if inserted {
+			counts[rec.Table]++
+		}
+	}
+
+	for _, t := range tables {
+		if !t.serial {
+			continue
+		}
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(
+			"SELECT setval(pg_get_serial_sequence($1, 'id'), max(id)) FROM %s HAVING max(id) IS NOT NULL",
+			pq.QuoteIdentifier(t.name),
+		), t.name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update the sequence of %s: %w", t.name, err)
+		}
+	}
+
+	return counts, tx.Commit()
+}
+
+// importRow inserts only the columns found in the archive, so columns added
+// by later migrations get their defaults.
+func importRow(ctx context.Context, tx *sql.Tx, rec Record) (bool, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Row, &fields); err != nil {
+		return false, err
+	}
+
+	columns := make([]string, 0, len(fields))
+	for name := range fields {
+		if !columnPattern.MatchString(name) {
+			return false, fmt.Errorf("invalid column %q", name)
+		}
+		columns = append(columns, pq.QuoteIdentifier(name))
+	}
+	slices.Sort(columns)
+	list := strings.Join(columns, ", ")
+
+	res, err := tx.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %[1]s (%[2]s) SELECT %[2]s FROM json_populate_record(NULL::%[1]s, $1) ON CONFLICT DO NOTHING",
+		pq.QuoteIdentifier(rec.Table),
+		list,
+	), string(rec.Row))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pressly/goose/v3"
+
+	"github.com/ip812/blog/auth"
+	"github.com/ip812/blog/backup"
+	"github.com/ip812/blog/config"
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/privacy"
+	"github.com/ip812/blog/store"
+)
+
+const commandDBTimeout = 1 * time.Minute
+
+func runCommand(name string, args []string) error {
+	switch name {
+	case "hash-password":
+		return hashPasswordCommand()
+	case "migrate":
+		return migrateCommand(args)
+	case "export":
+		return exportCommand(args)
+	case "import":
+		return importCommand(args)
+	case "erase-user":
+		return eraseUserCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// hashPasswordCommand reads a password from stdin and prints the argon2id
+// hash expected in ADMIN_PASSWORD_HASH.
+func hashPasswordCommand() error {
+	fmt.Fprint(os.Stderr, "password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return fmt.Errorf("failed to read password: %w", err)
+	}
+
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return fmt.Errorf("password must not be empty")
+	}
+
+	fmt.Println(auth.HashPassword(password))
+	return nil
+}
+
+// migrateCommand manages the embedded migrations of the configured database
+// driver:
+//
+//	migrate up|down|status|redo
+//	migrate create <name>
+func migrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down|status|redo|create <name>")
+	}
+
+	cfg := config.New()
+	if err := cfg.Err(); err != nil {
+		return err
+	}
+
+	if args[0] == "create" {
+		if len(args) != 2 {
+			return fmt.Errorf("usage: migrate create <name>")
+		}
+		dir := migrationsDir
+		if cfg.Database.Driver == config.DriverSQLite {
+			dir = sqliteMigrationsDir
+		}
+		path, err := createMigration(dir, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(path)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandDBTimeout)
+	defer cancel()
+
+	if cfg.Database.Driver == config.DriverSQLite {
+		return migrateSQLiteCommand(ctx, cfg, args[0])
+	}
+
+	var migrate func(db *sql.DB, dir string, opts ...goose.OptionsFunc) error
+	switch args[0] {
+	case "up":
+		migrate = goose.Up
+	case "down":
+		migrate = goose.Down
+	case "status":
+		migrate = goose.Status
+	case "redo":
+		migrate = goose.Redo
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+
+	conn, err := connectToDatabaseWithRetry(ctx, cfg, logger.NewCommand(cfg))
+	if err != nil {
+		return fmt.Errorf("failed to connect to the database: %w", err)
+	}
+	defer conn.Close()
+
+	return migrate(conn.db, migrationsDir)
+}
+
+func migrateSQLiteCommand(ctx context.Context, cfg *config.Config, command string) error {
+	db, err := openSQLite(ctx, cfg.Database.SQLitePath)
+	if err != nil {
+		return fmt.Errorf("failed to open the database: %w", err)
+	}
+	defer db.Close()
+
+	provider, err := sqliteMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "up":
+		_, err = provider.Up(ctx)
+	case "down":
+		_, err = provider.Down(ctx)
+	case "redo":
+		if _, err = provider.Down(ctx); err == nil {
+			_, err = provider.UpByOne(ctx)
+		}
+	case "status":
+		var statuses []*goose.MigrationStatus
+		statuses, err = provider.Status(ctx)
+		for _, st := range statuses {
+			fmt.Printf("%-10s %s\n", st.State, st.Source.Path)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q", command)
+	}
+
+	return err
+}
+
+// exportCommand writes a backup of the blog data to the given file, or to
+// stdout. The passkeys and recovery codes of the admin are left out unless
+// --include-admin-credentials is given:
+//
+//	export [--include-admin-credentials] [file]
+func exportCommand(args []string) error {
+	var opts backup.Options
+	if len(args) > 0 && args[0] == "--include-admin-credentials" {
+		opts.IncludeAdminCredentials = true
+		args = args[1:]
+	}
+	if len(args) > 1 || (len(args) == 1 && strings.HasPrefix(args[0], "-")) {
+		return fmt.Errorf("usage: export [--include-admin-credentials] [file]")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	conn, version, err := connectForBackup(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	out := os.Stdout
+	if len(args) == 1 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	counts, err := backup.Export(ctx, conn.db, version, out, opts)
+	if err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		if err := out.Sync(); err != nil {
+			return err
+		}
+	}
+
+	printCounts("exported", counts)
+	return nil
+}
+
+// importCommand restores a backup written by export:
+//
+//	import <file>
+func importCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: import <file>")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	conn, version, err := connectForBackup(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	counts, err := backup.Import(ctx, conn.db, version, f)
+	if err != nil {
+		return err
+	}
+
+	printCounts("imported", counts)
+	return nil
+}
+
+// connectForBackup connects to Postgres and returns the version of its last
+// applied migration.
+func connectForBackup(ctx context.Context) (dbConnection, int64, error) {
+	cfg := config.New()
+	if err := cfg.Err(); err != nil {
+		return dbConnection{}, 0, err
+	}
+	if cfg.Database.Driver != config.DriverPostgres {
+		return dbConnection{}, 0, fmt.Errorf("backups are only supported on Postgres")
+	}
+
+	connectCtx, cancel := context.WithTimeout(ctx, commandDBTimeout)
+	defer cancel()
+
+	conn, err := connectToDatabaseWithRetry(connectCtx, cfg, logger.NewCommand(cfg))
+	if err != nil {
+		return dbConnection{}, 0, fmt.Errorf("failed to connect to the database: %w", err)
+	}
+
+	version, err := goose.GetDBVersion(conn.db)
+	if err != nil {
+		conn.Close()
+		return dbConnection{}, 0, fmt.Errorf("failed to read the schema version: %w", err)
+	}
+
+	return conn, version, nil
+}
+
+func printCounts(verb string, counts backup.Counts) {
+	tables := make([]string, 0, len(counts))
+	for table := range counts {
+		tables = append(tables, table)
+	}
+	slices.Sort(tables)
+
+	for _, table := range tables {
+		fmt.Fprintf(os.Stderr, "%s %d rows of %s\n", verb, counts[table], table)
+	}
+}
+
+// eraseUserCommand deletes everything tied to a commenter, as the forget me
+// page does:
+//
+//	erase-user <username>
+func eraseUserCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: erase-user <username>")
+	}
+
+	cfg := config.New()
+	if err := cfg.Err(); err != nil {
+		return err
+	}
+	log := logger.NewCommand(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandDBTimeout)
+	defer cancel()
+
+	var service *privacy.Service
+	if cfg.Database.Driver == config.DriverSQLite {
+		db, err := openSQLite(ctx, cfg.Database.SQLitePath)
+		if err != nil {
+			return fmt.Errorf("failed to open the database: %w", err)
+		}
+		defer db.Close()
+		service = privacy.New(store.NewSQLite(db), nil, log, privacy.Retention{})
+	} else {
+		conn, err := connectToDatabaseWithRetry(ctx, cfg, log)
+		if err != nil {
+			return fmt.Errorf("failed to connect to the database: %w", err)
+		}
+		defer conn.Close()
+
+		db := NewSwappableDB()
+		db.Swap(conn.db)
+		service = privacy.New(store.NewPostgres(db), db, log, privacy.Retention{})
+	}
+
+	erased, err := service.Erase(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "erased %d comments, %d subscriptions and %d events\n", erased.Comments, erased.Subscriptions, erased.Events)
+	return nil
+}
@@ -1,9 +1,19 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+
+	"github.com/ip812/blog/secure"
 )
 
 type Environment string
@@ -22,26 +32,101 @@ func (e Environment) IsValid() bool {
 	}
 }
 
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
 type Config struct {
 	App struct {
-		Env    Environment
-		Domain string
-		Port   string
-		MetricsPort string
+		Env           Environment
+		Domain        string
+		Port          string
+		MetricsPort   string
+		SecretKey     string
+		EncryptionKey string
+		// SnowflakeMachineID is a number, "ordinal" to take it from the
+		// hostname of a StatefulSet pod (e.g. blog-2), or empty to lease
+		// one from Postgres.
+		SnowflakeMachineID string
+		// TrustedProxies are the proxies (e.g. the ingress) whose
+		// X-Forwarded-For header is used to find the client address.
+		TrustedProxies []netip.Prefix
 	}
 
 	Database struct {
-		Name     string
-		Endpoint string
-		SSLMode  string
-		Username string
-		Password string
+		Driver     string
+		SQLitePath string
+		Name       string
+		Endpoint   string
+		// read replicas share the name and credentials of the primary
+		ReplicaEndpoints []string
+		SSLMode          string
+		Username         string
+		Password         string
+		// PasswordFile takes precedence over Password, e.g. for mounted
+		// secrets. It is read whenever the DSN is built, so a rotated
+		// password is picked up on reconnect.
+		PasswordFile string
+		// Params are added to the DSN as they are, e.g.
+		// "application_name=blog&statement_timeout=30000".
+		Params          url.Values
+		MaxOpenConns    int
+		MaxIdleConns    int
+		ConnMaxLifetime time.Duration
+		ConnMaxIdleTime time.Duration
+		// QueryTimeout bounds every query, no limit when 0.
+		QueryTimeout time.Duration
+		AutoMigrate  bool
+	}
+
+	O11y struct {
+		// Disabled turns off exporting traces, metrics and logs over OTLP.
+		Disabled bool
+		// TraceSampleRatio is the share of new traces sampled, traces
+		// started by a caller follow the caller's decision.
+		TraceSampleRatio float64
+	}
+
+	Log struct {
+		// Level is the minimum level logged, ComponentLevels overrides it
+		// for single components (e.g. "outbox=debug,scheduler=warn").
+		Level           string
+		ComponentLevels map[string]string
+		// at most SampleBurst debug and info lines are logged per
+		// SamplePeriod while serving requests, zero logs all of them
+		SampleBurst  int
+		SamplePeriod time.Duration
+	}
+
+	// Retention is how long records holding personal data are kept, zero
+	// keeps them forever.
+	Retention struct {
+		PageViews    time.Duration
+		OutboxEvents time.Duration
+	}
+
+	Admin struct {
+		PasswordHash         string
+		TOTPSecret           string
+		PasswordWithPasskeys bool
 	}
 
 	Slack struct {
 		BlogBotToken     string
 		GeneralChannelID string
 	}
+
+	SMTP struct {
+		Host     string
+		Port     string
+		Username string
+		Password string
+		From     string
+	}
+
+	// errs are the settings that could not be read, see Validate
+	errs []error
 }
 
 func New() *Config {
@@ -60,13 +145,218 @@ func New() *Config {
 	cfg.App.Domain = os.Getenv("APP_DOMAIN")
 	cfg.App.Port = os.Getenv("APP_PORT")
 	cfg.App.MetricsPort = os.Getenv("APP_METRICS_PORT")
+	cfg.App.SecretKey = os.Getenv("APP_SECRET_KEY")
+	cfg.App.EncryptionKey = os.Getenv("APP_ENCRYPTION_KEY")
+	cfg.App.SnowflakeMachineID = os.Getenv("SNOWFLAKE_MACHINE_ID")
+	for _, proxy := range strings.Split(os.Getenv("APP_TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		}
+		prefix, err := parsePrefix(proxy)
+		if err != nil {
+			cfg.errs = append(cfg.errs, fmt.Errorf("APP_TRUSTED_PROXIES: %w", err))
+			continue
+		}
+		cfg.App.TrustedProxies = append(cfg.App.TrustedProxies, prefix)
+	}
+	cfg.Database.Driver = os.Getenv("DB_DRIVER")
+	if cfg.Database.Driver != DriverSQLite {
+		cfg.Database.Driver = DriverPostgres
+	}
+	cfg.Database.SQLitePath = os.Getenv("DB_SQLITE_PATH")
+	if cfg.Database.SQLitePath == "" {
+		cfg.Database.SQLitePath = "blog.db"
+	}
 	cfg.Database.Name = os.Getenv("DB_NAME")
 	cfg.Database.Endpoint = os.Getenv("DB_ENDPOINT")
+	for _, endpoint := range strings.Split(os.Getenv("DB_REPLICA_ENDPOINTS"), ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			cfg.Database.ReplicaEndpoints = append(cfg.Database.ReplicaEndpoints, endpoint)
+		}
+	}
 	cfg.Database.SSLMode = os.Getenv("DB_SSL_MODE")
 	cfg.Database.Username = os.Getenv("DB_USERNAME")
 	cfg.Database.Password = os.Getenv("DB_PASSWORD")
+	cfg.Database.PasswordFile = os.Getenv("DB_PASSWORD_FILE")
+	params, err := url.ParseQuery(os.Getenv("DB_PARAMS"))
+	if err != nil {
+		cfg.errs = append(cfg.errs, fmt.Errorf("DB_PARAMS: %w", err))
+	}
+	cfg.Database.Params = params
+	cfg.Database.MaxOpenConns = cfg.envInt("DB_MAX_OPEN_CONNS", 10)
+	cfg.Database.MaxIdleConns = cfg.envInt("DB_MAX_IDLE_CONNS", 2)
+	cfg.Database.ConnMaxLifetime = cfg.envDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute)
+	cfg.Database.ConnMaxIdleTime = cfg.envDuration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute)
+	cfg.Database.QueryTimeout = cfg.envDuration("DB_QUERY_TIMEOUT", 5*time.Second)
+	cfg.Database.AutoMigrate = os.Getenv("DB_AUTO_MIGRATE") != "false"
+	cfg.O11y.Disabled = os.Getenv("OTEL_SDK_DISABLED") == "true"
+	cfg.O11y.TraceSampleRatio = cfg.envFloat("OTEL_TRACES_SAMPLER_ARG", 1)
+	cfg.Log.Level = os.Getenv("LOG_LEVEL")
+	if cfg.Log.Level == "" {
+		cfg.Log.Level = "info"
+	}
+	cfg.Log.ComponentLevels = map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("LOG_LEVELS"), ",") {
+		component, level, ok := strings.Cut(pair, "=")
+		if ok {
+			cfg.Log.ComponentLevels[strings.TrimSpace(component)] = strings.TrimSpace(level)
+		}
+	}
+	cfg.Log.SampleBurst = cfg.envInt("LOG_SAMPLE_BURST", 100)
+	cfg.Log.SamplePeriod = cfg.envDuration("LOG_SAMPLE_PERIOD", time.Second)
+	cfg.Retention.PageViews = time.Duration(cfg.envInt("RETENTION_PAGE_VIEWS_DAYS", 395)) * 24 * time.Hour
+	cfg.Retention.OutboxEvents = time.Duration(cfg.envInt("RETENTION_OUTBOX_EVENTS_DAYS", 30)) * 24 * time.Hour
+	cfg.Admin.PasswordHash = os.Getenv("ADMIN_PASSWORD_HASH")
+	cfg.Admin.TOTPSecret = os.Getenv("ADMIN_TOTP_SECRET")
+	cfg.Admin.PasswordWithPasskeys = os.Getenv("ADMIN_PASSWORD_WITH_PASSKEYS") == "true"
 	cfg.Slack.BlogBotToken = os.Getenv("SLACK_BLOG_BOT_TOKEN")
 	cfg.Slack.GeneralChannelID = os.Getenv("SLACK_GENERAL_CHANNEL_ID")
+	cfg.SMTP.Host = os.Getenv("SMTP_HOST")
+	cfg.SMTP.Port = os.Getenv("SMTP_PORT")
+	cfg.SMTP.Username = os.Getenv("SMTP_USERNAME")
+	cfg.SMTP.Password = os.Getenv("SMTP_PASSWORD")
+	cfg.SMTP.From = os.Getenv("SMTP_FROM")
 
 	return cfg
 }
+
+// MinSecretKeyLength is the shortest APP_SECRET_KEY accepted, it signs the
+// links sent by mail, so a short one can be guessed offline.
+const MinSecretKeyLength = 32
+
+// publicSecrets are values .env.example used to ship with. They are public,
+// so a deployment copied from an old example must not run with them.
+var publicSecrets = []string{
+	"change-me-to-a-random-string-of-32-chars",
+	"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+	"$argon2id$v=19$m=65536,t=3,p=2$hCVzddk4d3eS7ZA17kxVhQ$v5JJ9Q8LhvW21le5BIhe3Mo85yw/fNl5owXNGt/UOZg",
+}
+
+// Err reports the settings that could not be read, e.g. DB_MAX_OPEN_CONNS=ten.
+func (c *Config) Err() error {
+	return errors.Join(c.errs...)
+}
+
+// Validate is Err plus the settings the blog can't safely serve with.
+func (c *Config) Validate() error {
+	errs := slices.Clone(c.errs)
+	if len(c.App.SecretKey) < MinSecretKeyLength {
+		errs = append(errs, fmt.Errorf("APP_SECRET_KEY must be at least %d characters", MinSecretKeyLength))
+	}
+	if c.App.EncryptionKey != "" {
+		if _, err := secure.NewCipher(c.App.EncryptionKey); err != nil {
+			errs = append(errs, fmt.Errorf("APP_ENCRYPTION_KEY: %w", err))
+		}
+	}
+	if c.Admin.PasswordHash != "" && !strings.HasPrefix(c.Admin.PasswordHash, "$argon2id$") {
+		errs = append(errs, errors.New("ADMIN_PASSWORD_HASH must be an argon2id hash, see `main hash-password`"))
+	}
+
+	for _, secret := range []struct{ key, value string }{
+		{"APP_SECRET_KEY", c.App.SecretKey},
+		{"APP_ENCRYPTION_KEY", c.App.EncryptionKey},
+		{"ADMIN_PASSWORD_HASH", c.Admin.PasswordHash},
+	} {
+		if slices.Contains(publicSecrets, secret.value) {
+			errs = append(errs, fmt.Errorf("%s is the example value of .env.example, set a secret of your own", secret.key))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DatabaseURL builds the DSN of the Postgres server at endpoint. Every part
+// is escaped, so credentials may contain any character.
+func (c *Config) DatabaseURL(endpoint string) (string, error) {
+	password := c.Database.Password
+	if c.Database.PasswordFile != "" {
+		b, err := os.ReadFile(c.Database.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the database password: %w", err)
+		}
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+
+	params := url.Values{}
+	for key, values := range c.Database.Params {
+		params[key] = values
+	}
+	if c.Database.SSLMode != "" {
+		params.Set("sslmode", c.Database.SSLMode)
+	}
+
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.Database.Username, password),
+		Host:     endpoint,
+		Path:     "/" + c.Database.Name,
+		RawQuery: params.Encode(),
+	}
+	return u.String(), nil
+}
+
+// BaseURL is the public address of the blog, used for links sent outside
+// of the browser (e.g. in emails).
+func (c *Config) BaseURL() string {
+	if c.App.Env == Local {
+		return fmt.Sprintf("http://%s:%s", c.App.Domain, c.App.Port)
+	}
+	return fmt.Sprintf("https://%s", c.App.Domain)
+}
+
+// envInt returns the integer in the environment variable key, or def when
+// it is unset. An invalid value is reported by Validate.
+func (c *Config) envInt(key string, def int) int {
+	raw, ok := os.LookupEnv(key)
+	if !ok || raw == "" {
+		return def
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		c.errs = append(c.errs, fmt.Errorf("%s: %q is not an integer", key, raw))
+		return def
+	}
+	return v
+}
+
+// envFloat returns the number in the environment variable key, or def when
+// it is unset. An invalid value is reported by Validate.
+func (c *Config) envFloat(key string, def float64) float64 {
+	raw, ok := os.LookupEnv(key)
+	if !ok || raw == "" {
+		return def
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		c.errs = append(c.errs, fmt.Errorf("%s: %q is not a number", key, raw))
+		return def
+	}
+	return v
+}
+
+// envDuration returns the duration (e.g. "30s") in the environment variable
+// key, or def when it is unset. An invalid value is reported by Validate.
+func (c *Config) envDuration(key string, def time.Duration) time.Duration {
+	raw, ok := os.LookupEnv(key)
+	if !ok || raw == "" {
+		return def
+	}
+	v, err := time.ParseDuration(raw)
+	if err != nil {
+		c.errs = append(c.errs, fmt.Errorf("%s: %q is not a duration (e.g. 30s)", key, raw))
+		return def
+	}
+	return v
+}
+
+// parsePrefix reads a network (e.g. "10.0.0.0/8") or a single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+func TestInvalidNumbersAreReported(t *testing.T) {
+	t.Setenv("DB_MAX_OPEN_CONNS", "ten")
+	t.Setenv("DB_QUERY_TIMEOUT", "5")
+	t.Setenv("DB_PARAMS", "application_name=blog;connect_timeout=%zz")
+
+	cfg := New()
+	err := cfg.Err()
+	if err == nil {
+		t.Fatal("expected an error for the invalid settings")
+	}
+	for _, key := range []string{"DB_MAX_OPEN_CONNS", "DB_QUERY_TIMEOUT", "DB_PARAMS"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error %q doesn't mention %s", err, key)
+		}
+	}
+	if cfg.Validate() == nil {
+		t.Error("expected Validate to report the invalid settings too")
+	}
+}
+
+func TestValidNumbers(t *testing.T) {
+	t.Setenv("DB_MAX_OPEN_CONNS", "10")
+	t.Setenv("DB_QUERY_TIMEOUT", "5s")
+
+	cfg := New()
+	if err := cfg.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database.QueryTimeout != 5*time.Second {
+		t.Errorf("QueryTimeout = %s, want 5s", cfg.Database.QueryTimeout)
+	}
+}
+
+func TestDefaultLogLevel(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "")
+
+	if level := New().Log.Level; level != "info" {
+		t.Errorf("Log.Level = %q, want info", level)
+	}
+}
+
+func TestExampleSecretsAreRejected(t *testing.T) {
+	example, err := godotenv.Read("../.env.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"APP_SECRET_KEY", "APP_ENCRYPTION_KEY", "ADMIN_PASSWORD_HASH"} {
+		t.Setenv(key, example[key])
+	}
+
+	err = New().Validate()
+	for _, key := range []string{"APP_SECRET_KEY", "APP_ENCRYPTION_KEY", "ADMIN_PASSWORD_HASH"} {
+		if err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("Validate() = %v, want %s of .env.example rejected", err, key)
+		}
+	}
+
+	// values of older examples are public too
+	for _, secret := range publicSecrets {
+		t.Setenv("APP_SECRET_KEY", secret)
+		if err := New().Validate(); err == nil || !strings.Contains(err.Error(), "example value") {
+			t.Errorf("Validate() = %v, want %q rejected", err, secret)
+		}
+	}
+}
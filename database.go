@@ -1,33 +1,94 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"net/http"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ip812/blog/status"
 )
 
+const (
+	primaryReadsCookieName = "IP812_BLOG_PRIMARY_READS"
+	// longer than replicas are expected to lag behind the primary
+	primaryReadsWindow = 10 * time.Second
+)
+
 type DBWrapper interface {
 	DB() (*sql.DB, error)
+	ReadDB(ctx context.Context) (*sql.DB, error)
+}
+
+type replica struct {
+	endpoint string
+	conn     dbConnection
+	healthy  atomic.Bool
+	// failures is only touched by the supervisor
+	failures int
 }
 
 type SwappableDB struct {
-	mu    sync.RWMutex
-	db    *sql.DB
-	ready bool
+	mu       sync.RWMutex
+	db       *sql.DB
+	ready    bool
+	replicas []*replica
+	next     atomic.Uint64
 }
 
 func NewSwappableDB() *SwappableDB {
 	return &SwappableDB{}
 }
 
-func (s *SwappableDB) Swap(db *sql.DB) {
+// Swap makes db the pool handed out from now on and returns the previous
+// one, which the caller is responsible for closing.
+func (s *SwappableDB) Swap(db *sql.DB) *sql.DB {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	old := s.db
 	s.db = db
 	s.ready = true
+	return old
 }
 
+// SetReplicas replaces the read replicas and returns the previous ones,
+// which the caller is responsible for closing.
+func (s *SwappableDB) SetReplicas(replicas []*replica) []*replica {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.replicas
+	s.replicas = replicas
+	return old
+}
+
+// ReplaceReplica swaps old for new and reports whether old was still in
+// use. The slice is copied, so callers iterating over Replicas are not
+// affected.
+func (s *SwappableDB) ReplaceReplica(old, new *replica) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.Index(s.replicas, old)
+	if i < 0 {
+		return false
+	}
+	replicas := slices.Clone(s.replicas)
+	replicas[i] = new
+	s.replicas = replicas
+	return true
+}
+
+func (s *SwappableDB) Replicas() []*replica {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.replicas
+}
+
+// DB returns the primary, which every write and every read that must see
+// the latest data goes to.
 func (s *SwappableDB) DB() (*sql.DB, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -36,3 +97,61 @@ func (s *SwappableDB) DB() (*sql.DB, error) {
 	}
 	return s.db, nil
 }
+
+// ReadDB returns a healthy read replica, taking turns between them. It falls
+// back to the primary when none is healthy or when ctx asks for primary
+// reads, e.g. right after the client wrote something.
+func (s *SwappableDB) ReadDB(ctx context.Context) (*sql.DB, error) {
+	if primaryReads(ctx) {
+		return s.DB()
+	}
+
+	replicas := s.Replicas()
+	if len(replicas) > 0 {
+		start := s.next.Add(1)
+		for i := range uint64(len(replicas)) {
+			r := replicas[(start+i)%uint64(len(replicas))]
+			if r.healthy.Load() {
+				return r.conn.db, nil
+			}
+		}
+	}
+
+	return s.DB()
+}
+
+type primaryReadsKey struct{}
+
+// withPrimaryReads makes ReadDB return the primary for ctx.
+func withPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadsKey{}, true)
+}
+
+func primaryReads(ctx context.Context) bool {
+	v, _ := ctx.Value(primaryReadsKey{}).(bool)
+	return v
+}
+
+// setPrimaryReads makes the client read from the primary for a while, so it
+// sees its own write even before the replicas caught up.
+func setPrimaryReads(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     primaryReadsCookieName,
+		Value:    "1",
+		Path:     "/",
+		MaxAge:   int(primaryReadsWindow.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// PrimaryReadsMiddleware sends the reads of clients that recently wrote
+// something to the primary.
+func PrimaryReadsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie(primaryReadsCookieName); err == nil {
+			r = r.WithContext(withPrimaryReads(r.Context()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
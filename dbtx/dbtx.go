@@ -0,0 +1,158 @@
+// Package dbtx instruments the database handles passed to the queries
+// generated by sqlc.
+package dbtx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ip812/blog/metrics"
+)
+
+var tracer = otel.Tracer("github.com/ip812/blog/dbtx")
+
+var queryTimeout atomic.Int64
+
+// SetQueryTimeout bounds every query run through Instrument from now on, no
+// limit when 0. Contexts with an earlier deadline keep theirs.
+func SetQueryTimeout(d time.Duration) {
+	queryTimeout.Store(int64(d))
+}
+
+// DBTX is what the queries generated by sqlc run on, for Postgres and SQLite
+// alike.
+type DBTX interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	PrepareContext(context.Context, string) (*sql.Stmt, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}
+
+type instrumented struct {
+	db DBTX
+}
+
+// Instrument wraps every query run on db in a span named after the query and
+// counts the failed ones by query name, e.g. database.New(dbtx.Instrument(tx)).
+// The spans are children of the span in the context passed to the query, so
+// handlers have to pass on the request context.
+func Instrument(db DBTX) DBTX {
+	return &instrumented{db: db}
+}
+
+func (i *instrumented) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	ctx, span := start(ctx, query)
+	defer span.End()
+	res, err := i.db.ExecContext(ctx, query, args...)
+	record(span, query, err)
+	return res, err
+}
+
+func (i *instrumented) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	ctx, span := start(ctx, query)
+	defer span.End()
+	stmt, err := i.db.PrepareContext(ctx, query)
+	record(span, query, err)
+	return stmt, err
+}
+
+func (i *instrumented) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	// the span ends before the rows are read, reading them is the caller's
+	// time
+	ctx = withReadTimeout(ctx)
+	ctx, span := start(ctx, query)
+	defer span.End()
+	rows, err := i.db.QueryContext(ctx, query, args...)
+	record(span, query, err)
+	return rows, err
+}
+
+func (i *instrumented) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx = withReadTimeout(ctx)
+	ctx, span := start(ctx, query)
+	defer span.End()
+	row := i.db.QueryRowContext(ctx, query, args...)
+	// Err reports the query failing, sql.ErrNoRows only comes from Scan
+	record(span, query, row.Err())
+	return row
+}
+
+// QueryName returns the name sqlc gives a query in its "-- name:" comment,
+// "unknown" for queries written by hand.
+func QueryName(query string) string {
+	rest, ok := strings.CutPrefix(query, "-- name: ")
+	if !ok {
+		return "unknown"
+	}
+	name, _, _ := strings.Cut(rest, " ")
+	return name
+}
+
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	d, ok := timeoutFor(ctx)
+	if !ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// withReadTimeout is withTimeout for queries returning rows. The rows are
+// read by the caller after the query method returns, and *sql.Rows and
+// *sql.Row can't be wrapped to cancel once they are closed, so the context
+// is never cancelled here. Its timer and its link to ctx are released when
+// the timeout fires or ctx is done, at most the query timeout later.
+func withReadTimeout(ctx context.Context) context.Context {
+	d, ok := timeoutFor(ctx)
+	if !ok {
+		return ctx
+	}
+	ctx, cancel := context.WithTimeout(ctx, d)
+	_ = cancel // released by the timeout, see above
+	return ctx
+}
+
+// timeoutFor reports the timeout to add to ctx, if any.
+func timeoutFor(ctx context.Context) (time.Duration, bool) {
+	d := time.Duration(queryTimeout.Load())
+	if d <= 0 {
+		return 0, false
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= d {
+		return 0, false
+	}
+	return d, true
+}
+
+func start(ctx context.Context, query string) (context.Context, trace.Span) {
+	name := QueryName(query)
+	return tracer.Start(ctx, "query "+name, trace.WithAttributes(
+		attribute.String("db.operation.name", name),
+	))
+}
+
+// record leaves requests that were cancelled out of the metrics, they say
+// nothing about the database.
+func record(span trace.Span, query string, err error) {
+	if err == nil || errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	metrics.DBErrors.WithLabelValues(QueryName(query)).Inc()
+}
@@ -0,0 +1,71 @@
+package dbtx
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// recordingDB keeps the context of the last query it ran.
+type recordingDB struct {
+	ctx context.Context
+}
+
+func (r *recordingDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	r.ctx = ctx
+	return nil, nil
+}
+
+func (r *recordingDB) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	r.ctx = ctx
+	return nil, nil
+}
+
+func (r *recordingDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	r.ctx = ctx
+	return nil, nil
+}
+
+func (r *recordingDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	r.ctx = ctx
+	return &sql.Row{}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	t.Cleanup(func() { SetQueryTimeout(0) })
+
+	rec := &recordingDB{}
+	db := Instrument(rec)
+	run := map[string]func(ctx context.Context){
+		"exec":     func(ctx context.Context) { db.ExecContext(ctx, "-- name: Exec :exec") },
+		"prepare":  func(ctx context.Context) { db.PrepareContext(ctx, "-- name: Prepare :one") },
+		"query":    func(ctx context.Context) { db.QueryContext(ctx, "-- name: Query :many") },
+		"queryRow": func(ctx context.Context) { db.QueryRowContext(ctx, "-- name: QueryRow :one") },
+	}
+
+	for name, query := range run {
+		t.Run(name, func(t *testing.T) {
+			SetQueryTimeout(0)
+			query(context.Background())
+			if _, ok := rec.ctx.Deadline(); ok {
+				t.Error("expected no deadline without a query timeout")
+			}
+
+			SetQueryTimeout(time.Minute)
+			query(context.Background())
+			deadline, ok := rec.ctx.Deadline()
+			if !ok || time.Until(deadline) > time.Minute {
+				t.Errorf("deadline = %v, %t, want one within a minute", deadline, ok)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			want, _ := ctx.Deadline()
+			query(ctx)
+			if got, _ := rec.ctx.Deadline(); !got.Equal(want) {
+				t.Errorf("deadline = %v, want the earlier one of the caller %v", got, want)
+			}
+		})
+	}
+}
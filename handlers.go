@@ -1,45 +1,93 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
+	"github.com/a-h/templ"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-playground/form"
 	"github.com/go-playground/validator/v10"
-	"github.com/godruoyi/go-snowflake"
 	"github.com/ip812/blog/articles"
+	"github.com/ip812/blog/auth"
 	"github.com/ip812/blog/config"
 	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtx"
+	"github.com/ip812/blog/idgen"
 	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/metrics"
+	"github.com/ip812/blog/newsletter"
+	"github.com/ip812/blog/outbox"
+	"github.com/ip812/blog/privacy"
+	"github.com/ip812/blog/replies"
+	"github.com/ip812/blog/scheduler"
 	"github.com/ip812/blog/status"
+	"github.com/ip812/blog/store"
+	"github.com/ip812/blog/suggestions"
 	"github.com/ip812/blog/templates/components"
 	"github.com/ip812/blog/templates/views"
 	"github.com/ip812/blog/utils"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
-var (
-	opsNewCommentsReceived = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "blog_new_comments_received_total",
-		Help: "Total number of new comments received",
-	})
-)
-
 //go:embed static
 var staticFS embed.FS
 
+// articleLabel is the metric label of articleID, only known articles get
+// one of their own.
+func articleLabel(articleID uint64) string {
+	if _, ok := articleViews[articleID]; !ok {
+		return metrics.UnknownArticle
+	}
+	return strconv.FormatUint(articleID, 10)
+}
+
+// articleView is a view rendering an article, with the name its render
+// span is given.
+type articleView struct {
+	name string
+	view func() templ.Component
+}
+
+// articleViews maps article IDs to the views rendering them.
+var articleViews = map[uint64]articleView{
+	articles.ZeroTrustHomelabID:                     {"views.ArticleZeroTrustHomelab", views.ArticleZeroTrustHomelab},
+	articles.ZeroTrustHomelabV2ID:                   {"views.ArticleZeroTrustHomelabV2", views.ArticleZeroTrustHomelabV2},
+	articles.AnsiblePlusTailsclaleEqualGreatComboID: {"views.ArticleAnsiblePlusTailscaleEqualGreatCombo", views.ArticleAnsiblePlusTailscaleEqualGreatCombo},
+	articles.DeferDeepDiveID:                        {"views.ArticleDeferDeepDive", views.ArticleDeferDeepDive},
+	articles.SelfManagedObservabilityStackID:        {"views.ArticleSelfManagedObservabilityStack", views.ArticleSelfManagedObservabilityStack},
+	articles.SystemdGoApp:                           {"views.ArticleSystemdGoApp", views.ArticleSystemdGoApp},
+}
+
 type Handler struct {
 	config        *config.Config
 	formDecoder   *form.Decoder
 	formValidator *validator.Validate
 	tracer        oteltrace.Tracer
 	log           logger.Logger
+	newsletter    *newsletter.Service
+	replies       *replies.Service
+	credentials   *auth.Credentials
+	sessions      *auth.Sessions
+	loginThrottle *auth.Throttle
+	// accountThrottle limits password and recovery code guesses for the
+	// admin account from all addresses together
+	accountThrottle *auth.Throttle
+	passkeys        *auth.Passkeys
+	recoveryCodes   *auth.RecoveryCodes
+	suggestions     *suggestions.Service
+	readiness       *Readiness
+	comments        store.CommentStore
+	privacy         *privacy.Service
+	scheduler       *scheduler.Scheduler
 
 	db DBWrapper
 }
@@ -54,160 +102,257 @@ func (hnd *Handler) StaticFiles() http.Handler {
 	return http.StripPrefix("/", http.FileServer(http.FS(staticFS)))
 }
 
-func (hnd *Handler) Healthz(w http.ResponseWriter, r *http.Request) {
+func (hnd *Handler) Livez(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte{})
 }
 
+func (hnd *Handler) Readyz(w http.ResponseWriter, r *http.Request) {
+	// telemetry is reported but doesn't make the app unready
+	res := struct {
+		Ready     bool              `json:"ready"`
+		Checks    map[string]string `json:"checks"`
+		Telemetry string            `json:"telemetry"`
+	}{
+		Ready:     true,
+		Checks:    map[string]string{},
+		Telemetry: hnd.readiness.Telemetry(),
+	}
+	for name, err := range hnd.readiness.Check(r.Context()) {
+		if err != nil {
+			res.Ready = false
+			res.Checks[name] = err.Error()
+			continue
+		}
+		res.Checks[name] = "ok"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !res.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// commentCreated records the side effects of a new comment in the
+// transaction creating it.
+func (hnd *Handler) commentCreated(ctx context.Context, c store.Comment, email string) error {
+	tx, ok := store.Tx(ctx)
+	if !ok {
+		// without Postgres there is no outbox to notify anyone through, an
+		// opt-in would be lost, so the commenter is told instead
+		if email != "" {
+			return replies.ErrDisabled
+		}
+		logger.FromContext(ctx).Debug("comment store has no transaction, skipping side effects of comment %d", c.ID)
+		return nil
+	}
+
+	queries := database.New(dbtx.Instrument(tx))
+
+	err := outbox.Enqueue(
+		ctx,
+		queries,
+		outbox.EventCommentCreated,
+		fmt.Sprintf("%s:%d", outbox.EventCommentCreated, c.ID),
+		outbox.CommentCreatedPayload{
+			CommentID: c.ID,
+			ArticleID: c.ArticleID,
+			Username:  c.Username,
+			Content:   c.Content,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	if email != "" {
+		return hnd.replies.Subscribe(ctx, queries, c.ArticleID, c.Username, email)
+	}
+
+	return nil
+}
+
+func (hnd *Handler) commentsUnavailable(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Retry-After", "60")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	return utils.Render(w, r, "components.CommentsUnavailable", components.CommentsUnavailable())
+}
+
 func (hnd *Handler) LandingPageView(w http.ResponseWriter, r *http.Request) {
-	utils.Render(w, r, views.LandingPage())
+	utils.Render(w, r, "views.LandingPage", views.LandingPage())
 }
 
 func (hnd *Handler) ArticlesView(w http.ResponseWriter, r *http.Request) {
-	utils.Render(w, r, views.Articles())
+	utils.Render(w, r, "views.Articles", views.Articles())
 }
 
 func (hnd *Handler) ProjectsView(w http.ResponseWriter, r *http.Request) {
-	utils.Render(w, r, views.Projects())
+	utils.Render(w, r, "views.Projects", views.Projects())
 }
 
 func (hnd *Handler) ArticleDetailsView(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
 	if err != nil {
-		utils.Render(w, r, views.ArticleNotFound())
+		w.WriteHeader(http.StatusNotFound)
+		utils.Render(w, r, "views.ArticleNotFound", views.ArticleNotFound())
 		return
 	}
 
-	if id == articles.ZeroTrustHomelabID {
-		utils.Render(w, r, views.ArticleZeroTrustHomelab())
+	article, ok := articleViews[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		utils.Render(w, r, "views.ArticleNotFound", views.ArticleNotFound())
 		return
 	}
 
-	if id == articles.ZeroTrustHomelabV2ID {
-		utils.Render(w, r, views.ArticleZeroTrustHomelabV2())
-		return
-	}
-
-	if id == articles.AnsiblePlusTailsclaleEqualGreatComboID {
-		utils.Render(w, r, views.ArticleAnsiblePlusTailscaleEqualGreatCombo())
-		return
-	}
-
-	if id == articles.DeferDeepDiveID {
-		utils.Render(w, r, views.ArticleDeferDeepDive())
-		return
-	}
-
-	if id == articles.SelfManagedObservabilityStackID {
-		utils.Render(w, r, views.ArticleSelfManagedObservabilityStack())
-		return
-	}
+	metrics.ArticleViews.WithLabelValues(articleLabel(id)).Inc()
+	utils.Render(w, r, article.name, article.view())
+}
 
-	if id == articles.SystemdGoApp {
-		utils.Render(w, r, views.ArticleSystemdGoApp())
-		return
+// getOrSetUsername returns the username of the signed cookie of r, or gives
+// the browser a new one. Unsigned cookies, set before usernames were signed,
+// are replaced too, as anyone could have made them up. Their earlier
+// comments keep the old username and are only erased by `main erase-user`,
+// see ForgetMe.
+func (hnd *Handler) getOrSetUsername(w http.ResponseWriter, r *http.Request) (string, error) {
+	if c, err := r.Cookie(CookieKey); err == nil {
+		if username, ok := verifyUsername(hnd.config.App.SecretKey, c.Value); ok {
+			return username, nil
+		}
 	}
 
-	utils.Render(w, r, views.ArticleNotFound())
-}
-
-func getOrSetUsername(w http.ResponseWriter, r *http.Request) string {
-	c, err := r.Cookie(CookieKey)
+	username, err := generateUsername()
 	if err != nil {
-		username := generateUsername()
-		http.SetCookie(w, &http.Cookie{
-			Name:     CookieKey,
-			Value:    username,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   false,
-			SameSite: http.SameSiteStrictMode,
-		})
-		return username
+		return "", err
 	}
-	return c.Value
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieKey,
+		Value:    signUsername(hnd.config.App.SecretKey, username),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return username, nil
 }
 
 func (hnd *Handler) CreateComment(w http.ResponseWriter, r *http.Request) error {
+	// everything below runs in this span, down to the queries and the
+	// rendering of the comments
+	ctx, span := hnd.tracer.Start(r.Context(), "CreateComment")
+	defer span.End()
+	r = r.WithContext(ctx)
+
 	articleID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
 	if err != nil {
+		metrics.CommentsRejected.WithLabelValues(metrics.UnknownArticle, metrics.RejectInvalidArticle).Inc()
 		status.AddToast(w, status.WarningStatusBadRequest(status.WarnNotNumbericID))
-		return utils.Render(w, r, components.NoComments())
+		return utils.Render(w, r, "components.NoComments", components.NoComments())
 	}
+	span.SetAttributes(attribute.String("article", strconv.FormatUint(articleID, 10)))
 
 	err = r.ParseForm()
 	if err != nil {
+		metrics.CommentsRejected.WithLabelValues(articleLabel(articleID), metrics.RejectInvalidForm).Inc()
 		status.AddToast(w, status.ErrorInternalServerError(status.ErrParsingFrom))
-		return utils.Render(w, r, components.NoComments())
+		return utils.Render(w, r, "components.NoComments", components.NoComments())
 	}
 	var props components.CommentInputFormProps
 	err = hnd.formDecoder.Decode(&props, r.Form)
 	if err != nil {
+		metrics.CommentsRejected.WithLabelValues(articleLabel(articleID), metrics.RejectInvalidForm).Inc()
 		status.AddToast(w, status.ErrorInternalServerError(status.ErrDecodingForm))
-		return utils.Render(w, r, components.NoComments())
+		return utils.Render(w, r, "components.NoComments", components.NoComments())
 	}
 
-	_, span := hnd.tracer.Start(
-		r.Context(),
-		"CreateComment(",
-		oteltrace.WithAttributes(attribute.String("article", string(props.ArticleID))),
-	)
-	defer span.End()
+	props.Email = strings.TrimSpace(props.Email)
+	if err := hnd.formValidator.Struct(props); err != nil {
+		metrics.CommentsRejected.WithLabelValues(articleLabel(articleID), metrics.RejectInvalidEmail).Inc()
+		status.AddToast(w, status.WarningStatusBadRequest(status.WarnInvalidEmail))
+		return utils.Render(w, r, "components.NoComments", components.NoComments())
+	}
 
-	username := getOrSetUsername(w, r)
+	if props.Email != "" && !hnd.replies.Enabled() {
+		metrics.CommentsRejected.WithLabelValues(articleLabel(articleID), metrics.RejectNoReplyEmails).Inc()
+		status.AddToast(w, status.WarningStatusBadRequest(status.WarnNoReplyEmails))
+		return utils.Render(w, r, "components.NoComments", components.NoComments())
+	}
 
-	db, err := hnd.db.DB()
-	if err != nil {
-		status.AddToast(w, status.ErrorInternalServerError(status.ErrDB))
-		return utils.Render(w, r, components.NoComments())
+	if !hnd.readiness.Migrated() {
+		metrics.CommentsRejected.WithLabelValues(articleLabel(articleID), metrics.RejectUnavailable).Inc()
+		return hnd.commentsUnavailable(w, r)
 	}
 
-	tx, err := db.BeginTx(r.Context(), nil)
+	username, err := hnd.getOrSetUsername(w, r)
+	if errors.Is(err, idgen.ErrNoMachineID) {
+		metrics.CommentsRejected.WithLabelValues(articleLabel(articleID), metrics.RejectUnavailable).Inc()
+		return hnd.commentsUnavailable(w, r)
+	}
 	if err != nil {
-		status.AddToast(w, status.ErrorInternalServerError(status.ErrDB))
-		return utils.Render(w, r, components.NoComments())
+		metrics.CommentsRejected.WithLabelValues(articleLabel(articleID), metrics.RejectError).Inc()
+		status.AddToast(w, status.ErrorInternalServerError(status.ErrCreateArticleComment))
+		return utils.Render(w, r, "components.NoComments", components.NoComments())
+	}
+	id, err := idgen.NextID()
+	if errors.Is(err, idgen.ErrNoMachineID) {
+		metrics.CommentsRejected.WithLabelValues(articleLabel(articleID), metrics.RejectUnavailable).Inc()
+		return hnd.commentsUnavailable(w, r)
 	}
-	defer tx.Rollback()
-
-	queries := database.New(tx)
-
-	_, err = queries.CreateComment(r.Context(), database.CreateCommentParams{
-		ID:        int64(snowflake.ID()),
-		ArticleID: int64(articleID),
-		Username:  username,
-		Content:   props.Content,
-	})
 	if err != nil {
+		metrics.CommentsRejected.WithLabelValues(articleLabel(articleID), metrics.RejectError).Inc()
 		status.AddToast(w, status.ErrorInternalServerError(status.ErrCreateArticleComment))
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return utils.Render(w, r, components.NoComments())
+		return utils.Render(w, r, "components.NoComments", components.NoComments())
 	}
 
-	comments, err := queries.GetAllCommentsByArticleID(r.Context(), int64(articleID))
+	comment, err := hnd.comments.Create(
+		r.Context(),
+		store.Comment{
+			ID:        id,
+			ArticleID: int64(articleID),
+			Username:  username,
+			Content:   props.Content,
+		},
+		func(ctx context.Context, c store.Comment) error {
+			return hnd.commentCreated(ctx, c, props.Email)
+		},
+	)
+	if errors.Is(err, status.ErrDatabaseNotReady) {
+		metrics.CommentsRejected.WithLabelValues(articleLabel(articleID), metrics.RejectUnavailable).Inc()
+		return hnd.commentsUnavailable(w, r)
+	}
+	if errors.Is(err, replies.ErrDisabled) {
+		metrics.CommentsRejected.WithLabelValues(articleLabel(articleID), metrics.RejectNoReplyEmails).Inc()
+		status.AddToast(w, status.WarningStatusBadRequest(status.WarnNoReplyEmails))
+		return utils.Render(w, r, "components.NoComments", components.NoComments())
+	}
 	if err != nil {
-		status.AddToast(w, status.ErrorInternalServerError(status.ErrGetAllArticleComments))
+		metrics.CommentsRejected.WithLabelValues(articleLabel(articleID), metrics.RejectError).Inc()
+		status.AddToast(w, status.ErrorInternalServerError(status.ErrCreateArticleComment))
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return utils.Render(w, r, components.NoComments())
+		return utils.Render(w, r, "components.NoComments", components.NoComments())
 	}
 
-	if err := tx.Commit(); err != nil {
-		status.AddToast(w, status.ErrorInternalServerError(status.ErrDB))
+	metrics.CommentsCreated.WithLabelValues(articleLabel(articleID)).Inc()
+
+	setPrimaryReads(w)
+	comments, err := hnd.comments.ListByArticle(withPrimaryReads(r.Context()), comment.ArticleID)
+	if err != nil {
+		status.AddToast(w, status.ErrorInternalServerError(status.ErrGetAllArticleComments))
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return utils.Render(w, r, components.NoComments())
+		return utils.Render(w, r, "components.NoComments", components.NoComments())
 	}
 
 	if len(comments) == 0 {
-		hnd.log.Warn("no comments found after creating a comment")
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return utils.Render(w, r, components.NoComments())
+		logger.FromContext(r.Context()).With("article_id", articleID).Warn("no comments found after creating a comment")
+		span.SetStatus(codes.Error, "no comments found after creating a comment")
+		return utils.Render(w, r, "components.NoComments", components.NoComments())
 	}
 
-	opsNewCommentsReceived.Inc()
-	hnd.log.Info("comment created successfully for article ID %d", articleID)
+	logger.FromContext(r.Context()).With("article_id", articleID).Info("comment created successfully")
 
 	commentProps := []components.CommentProps{}
 	for _, c := range comments {
@@ -219,32 +364,31 @@ func (hnd *Handler) CreateComment(w http.ResponseWriter, r *http.Request) error
 		})
 	}
 
-	return utils.Render(w, r, components.Comments(commentProps))
+	return utils.Render(w, r, "components.Comments", components.Comments(commentProps))
 }
 
 func (hnd *Handler) GetAllCommentsByArticleID(w http.ResponseWriter, r *http.Request) error {
-	db, err := hnd.db.DB()
-	if err != nil {
-		status.AddToast(w, status.ErrorInternalServerError(status.ErrDB))
-		return utils.Render(w, r, components.NoComments())
-	}
-
-	queries := database.New(db)
-
 	articleID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
 	if err != nil {
 		status.AddToast(w, status.WarningStatusBadRequest(status.WarnNotNumbericID))
-		return utils.Render(w, r, components.NoComments())
+		return utils.Render(w, r, "components.NoComments", components.NoComments())
 	}
 
-	comments, err := queries.GetAllCommentsByArticleID(r.Context(), int64(articleID))
+	if !hnd.readiness.Migrated() {
+		return hnd.commentsUnavailable(w, r)
+	}
+
+	comments, err := hnd.comments.ListByArticle(r.Context(), int64(articleID))
+	if errors.Is(err, status.ErrDatabaseNotReady) {
+		return hnd.commentsUnavailable(w, r)
+	}
 	if err != nil {
 		status.AddToast(w, status.ErrorInternalServerError(status.ErrGetAllArticleComments))
-		return utils.Render(w, r, components.NoComments())
+		return utils.Render(w, r, "components.NoComments", components.NoComments())
 	}
 
 	if len(comments) == 0 {
-		return utils.Render(w, r, components.NoComments())
+		return utils.Render(w, r, "components.NoComments", components.NoComments())
 	}
 
 	commentProps := []components.CommentProps{}
@@ -257,5 +401,5 @@ func (hnd *Handler) GetAllCommentsByArticleID(w http.ResponseWriter, r *http.Req
 		})
 	}
 
-	return utils.Render(w, r, components.Comments(commentProps))
+	return utils.Render(w, r, "components.Comments", components.Comments(commentProps))
 }
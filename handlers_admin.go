@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/ip812/blog/auth"
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/middleware"
+	"github.com/ip812/blog/templates/views"
+	"github.com/ip812/blog/utils"
+)
+
+// adminAccount keys the per-account login throttle, there is a single admin.
+const adminAccount = "admin"
+
+// adminNavItems are the management pages linked from the admin layout.
+var adminNavItems = []views.AdminNavItem{
+	{Name: "Dashboard", URL: "/admin"},
+	{Name: "Analytics", URL: "/admin/analytics"},
+	{Name: "Jobs", URL: "/admin/jobs"},
+	{Name: "Security", URL: "/admin/security"},
+}
+
+func (hnd *Handler) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := hnd.sessions.Validate(r.Context(), w, r)
+		if errors.Is(err, auth.ErrNoSession) {
+			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			logger.FromContext(r.Context()).Error("failed to validate admin session: %s", err.Error())
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (hnd *Handler) AdminLoginView(w http.ResponseWriter, r *http.Request) {
+	props := hnd.adminLoginProps(r, "")
+	if !props.PasswordLogin && !props.PasskeyLogin {
+		http.NotFound(w, r)
+		return
+	}
+
+	utils.Render(w, r, "views.AdminLogin", views.AdminLogin(props))
+}
+
+func (hnd *Handler) AdminLogin(w http.ResponseWriter, r *http.Request) {
+	if !hnd.passwordLoginEnabled(hnd.passkeyCount(r.Context())) {
+		http.NotFound(w, r)
+		return
+	}
+
+	ip := middleware.ClientIP(r)
+
+	if !hnd.loginAllowed(ip) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		utils.Render(w, r, "views.AdminLogin", views.AdminLogin(hnd.adminLoginProps(r, "Too many failed attempts, try again later.")))
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		utils.Render(w, r, "views.AdminLogin", views.AdminLogin(hnd.adminLoginProps(r, "Invalid request.")))
+		return
+	}
+
+	if !hnd.credentials.Check(r.PostForm.Get("Password"), r.PostForm.Get("Code")) {
+		hnd.loginFailed(ip)
+		logger.FromContext(r.Context()).Warn("failed admin login attempt from %s", ip)
+		w.WriteHeader(http.StatusUnauthorized)
+		utils.Render(w, r, "views.AdminLogin", views.AdminLogin(hnd.adminLoginProps(r, "Invalid credentials.")))
+		return
+	}
+	hnd.loginSucceeded(ip)
+
+	if err := hnd.sessions.Create(r.Context(), w); err != nil {
+		logger.FromContext(r.Context()).Error("failed to create admin session: %s", err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		utils.Render(w, r, "views.AdminLogin", views.AdminLogin(hnd.adminLoginProps(r, "Login is temporarily unavailable.")))
+		return
+	}
+
+	logger.FromContext(r.Context()).Info("admin logged in from %s", ip)
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+func (hnd *Handler) AdminLogout(w http.ResponseWriter, r *http.Request) {
+	if err := hnd.sessions.Destroy(r.Context(), w, r); err != nil {
+		logger.FromContext(r.Context()).Error("failed to destroy admin session: %s", err.Error())
+	}
+	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+}
+
+func (hnd *Handler) AdminDashboardView(w http.ResponseWriter, r *http.Request) {
+	utils.Render(w, r, "views.AdminDashboard", views.AdminDashboard(adminNavItems))
+}
+
+func (hnd *Handler) adminLoginProps(r *http.Request, errMsg string) views.AdminLoginProps {
+	passkeys := hnd.passkeyCount(r.Context())
+	props := views.AdminLoginProps{
+		PasswordLogin: hnd.passwordLoginEnabled(passkeys),
+		PasskeyLogin:  passkeys > 0,
+		Error:         errMsg,
+	}
+	if props.PasswordLogin {
+		props.RequiresPassword = hnd.credentials.RequiresPassword()
+		props.RequiresTOTP = hnd.credentials.RequiresTOTP()
+	}
+
+	return props
+}
+
+// passwordLoginEnabled reports whether the password form may be used. Once a
+// passkey is registered the password is turned off, unless the config keeps it.
+func (hnd *Handler) passwordLoginEnabled(passkeys int64) bool {
+	if hnd.credentials == nil {
+		return false
+	}
+	return passkeys == 0 || hnd.config.Admin.PasswordWithPasskeys
+}
+
+func (hnd *Handler) passkeyCount(ctx context.Context) int64 {
+	if hnd.passkeys == nil {
+		return 0
+	}
+
+	count, err := hnd.passkeys.Count(ctx)
+	if err != nil {
+		logger.FromContext(ctx).Error("failed to count passkeys: %s", err.Error())
+		return 0
+	}
+
+	return count
+}
+
+// loginAllowed reports whether a password or recovery code may be tried
+// from ip. Besides the per-address limit the admin account has one of its
+// own, so an attacker spreading guesses over many addresses is slowed down
+// too. Passkey logins only count against the address, a passkey can't be
+// guessed and stays usable while the account limit is hit.
+func (hnd *Handler) loginAllowed(ip string) bool {
+	return hnd.loginThrottle.Allowed(ip) && hnd.accountThrottle.Allowed(adminAccount)
+}
+
+func (hnd *Handler) loginFailed(ip string) {
+	hnd.loginThrottle.Fail(ip)
+	hnd.accountThrottle.Fail(adminAccount)
+}
+
+func (hnd *Handler) loginSucceeded(ip string) {
+	hnd.loginThrottle.Reset(ip)
+	hnd.accountThrottle.Reset(adminAccount)
+}
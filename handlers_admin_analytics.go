@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/ip812/blog/articles"
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtx"
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/templates/views"
+	"github.com/ip812/blog/utils"
+)
+
+const (
+	analyticsDefaultDays  = 30
+	analyticsTopReferrers = 20
+)
+
+var analyticsDayOptions = []int{7, 30, 90, 365}
+
+func (hnd *Handler) AdminAnalyticsView(w http.ResponseWriter, r *http.Request) {
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || !slices.Contains(analyticsDayOptions, days) {
+		days = analyticsDefaultDays
+	}
+
+	props := views.AdminAnalyticsProps{
+		Nav:        adminNavItems,
+		Days:       days,
+		DayOptions: analyticsDayOptions,
+	}
+
+	var articleID sql.NullInt64
+	if id, err := strconv.ParseUint(r.URL.Query().Get("article"), 10, 64); err == nil {
+		if article := articles.GetByID(id); article != nil {
+			articleID = sql.NullInt64{Int64: int64(id), Valid: true}
+			props.ArticleID = strconv.FormatUint(id, 10)
+			props.ArticleName = article.Name
+		}
+	}
+
+	db, err := hnd.db.DB()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	queries := database.New(dbtx.Instrument(db))
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-days)
+
+	totals, err := queries.GetPageViewTotals(r.Context(), since)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get page view totals: %s", err.Error())
+		http.Error(w, "failed to load analytics", http.StatusInternalServerError)
+		return
+	}
+	props.TotalViews = totals.Views
+	props.TotalUniques = totals.Uniques
+
+	daily, err := queries.GetDailyPageViews(r.Context(), database.GetDailyPageViewsParams{
+		Since:     since,
+		ArticleID: articleID,
+	})
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get daily page views: %s", err.Error())
+		http.Error(w, "failed to load analytics", http.StatusInternalServerError)
+		return
+	}
+	var busiest int64
+	for _, day := range daily {
+		busiest = max(busiest, day.Views)
+	}
+	for _, day := range daily {
+		props.Daily = append(props.Daily, views.AdminDailyStats{
+			Day:     day.Day.Format("2006-01-02"),
+			Views:   day.Views,
+			Uniques: day.Uniques,
+			Percent: int(day.Views * 100 / busiest),
+		})
+	}
+
+	perArticle, err := queries.GetArticlePageViews(r.Context(), since)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get article page views: %s", err.Error())
+		http.Error(w, "failed to load analytics", http.StatusInternalServerError)
+		return
+	}
+	for _, row := range perArticle {
+		article := articles.GetByID(uint64(row.ArticleID))
+		if article == nil {
+			continue
+		}
+		props.Articles = append(props.Articles, views.AdminArticleStats{
+			ID:      strconv.FormatInt(row.ArticleID, 10),
+			Name:    article.Name,
+			Views:   row.Views,
+			Uniques: row.Uniques,
+		})
+	}
+
+	referrers, err := queries.GetTopReferrers(r.Context(), database.GetTopReferrersParams{
+		ViewedAt: since,
+		Limit:    analyticsTopReferrers,
+	})
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get top referrers: %s", err.Error())
+		http.Error(w, "failed to load analytics", http.StatusInternalServerError)
+		return
+	}
+	for _, row := range referrers {
+		props.Referrers = append(props.Referrers, views.AdminReferrerStats{
+			Host:  row.ReferrerHost,
+			Views: row.Views,
+		})
+	}
+
+	utils.Render(w, r, "views.AdminAnalytics", views.AdminAnalytics(props))
+}
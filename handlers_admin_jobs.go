@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/templates/views"
+	"github.com/ip812/blog/utils"
+)
+
+func (hnd *Handler) AdminJobsView(w http.ResponseWriter, r *http.Request) {
+	jobs, err := hnd.scheduler.Jobs(r.Context())
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to get scheduled jobs: %s", err.Error())
+		http.Error(w, "failed to load jobs", http.StatusInternalServerError)
+		return
+	}
+
+	props := views.AdminJobsProps{Nav: adminNavItems}
+	for _, job := range jobs {
+		status := views.AdminJobStatus{
+			Name:     job.Name,
+			Schedule: job.Schedule,
+			NextRun:  job.NextRunAt.UTC().Format(time.DateTime),
+			Runner:   job.Runner.String,
+			Outcome:  job.LastOutcome.String,
+			Error:    job.LastError.String,
+		}
+		if job.LastStartedAt.Valid {
+			status.LastRun = job.LastStartedAt.Time.UTC().Format(time.DateTime)
+		}
+		if job.LastDurationMs.Valid {
+			status.Duration = (time.Duration(job.LastDurationMs.Int64) * time.Millisecond).String()
+		}
+		props.Jobs = append(props.Jobs, status)
+	}
+
+	utils.Render(w, r, "views.AdminJobs", views.AdminJobs(props))
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ip812/blog/auth"
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/middleware"
+	"github.com/ip812/blog/templates/views"
+	"github.com/ip812/blog/utils"
+)
+
+const (
+	ceremonyCookieName = "IP812_BLOG_ADMIN_CEREMONY"
+	ceremonyCookieTTL  = 5 * time.Minute
+	passkeyNameMaxLen  = 64
+)
+
+func (hnd *Handler) AdminSecurityView(w http.ResponseWriter, r *http.Request) {
+	hnd.renderAdminSecurity(w, r, nil)
+}
+
+func (hnd *Handler) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	creation, ceremonyID, err := hnd.passkeys.BeginRegistration(r.Context())
+	if errors.Is(err, auth.ErrTooManyCeremonies) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to begin passkey registration: %s", err.Error())
+		http.Error(w, "failed to begin passkey registration", http.StatusInternalServerError)
+		return
+	}
+
+	hnd.setCeremonyCookie(w, ceremonyID)
+	writeJSON(w, creation)
+}
+
+func (hnd *Handler) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" || len(name) > passkeyNameMaxLen {
+		http.Error(w, "passkey name is required", http.StatusBadRequest)
+		return
+	}
+
+	c, err := r.Cookie(ceremonyCookieName)
+	if err != nil {
+		http.Error(w, auth.ErrCeremonyExpired.Error(), http.StatusBadRequest)
+		return
+	}
+	hnd.clearCeremonyCookie(w)
+
+	err = hnd.passkeys.FinishRegistration(r.Context(), c.Value, name, r.Body)
+	if err != nil {
+		logger.FromContext(r.Context()).Warn("failed to finish passkey registration: %s", err.Error())
+		http.Error(w, "passkey registration failed", http.StatusBadRequest)
+		return
+	}
+
+	logger.FromContext(r.Context()).Info("admin registered passkey %q", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (hnd *Handler) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	id, err := base64.RawURLEncoding.DecodeString(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid passkey id", http.StatusBadRequest)
+		return
+	}
+
+	if err := hnd.passkeys.Delete(r.Context(), id); err != nil {
+		logger.FromContext(r.Context()).Error("failed to delete passkey: %s", err.Error())
+		http.Error(w, "failed to delete passkey", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+}
+
+func (hnd *Handler) GenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	codes, err := hnd.recoveryCodes.Generate(r.Context())
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to generate recovery codes: %s", err.Error())
+		http.Error(w, "failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	logger.FromContext(r.Context()).Info("admin generated new recovery codes")
+	hnd.renderAdminSecurity(w, r, codes)
+}
+
+// BeginPasskeyLogin counts as a failed attempt of the client until the login
+// is finished, so the ceremonies stored for it are bound by the login
+// throttle.
+func (hnd *Handler) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	ip := middleware.ClientIP(r)
+	if !hnd.loginThrottle.Allowed(ip) {
+		http.Error(w, "too many failed attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+	hnd.loginThrottle.Fail(ip)
+
+	assertion, ceremonyID, err := hnd.passkeys.BeginLogin(r.Context())
+	if errors.Is(err, auth.ErrNoPasskeys) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, auth.ErrTooManyCeremonies) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to begin passkey login: %s", err.Error())
+		http.Error(w, "failed to begin passkey login", http.StatusInternalServerError)
+		return
+	}
+
+	hnd.setCeremonyCookie(w, ceremonyID)
+	writeJSON(w, assertion)
+}
+
+func (hnd *Handler) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	ip := middleware.ClientIP(r)
+	if !hnd.loginThrottle.Allowed(ip) {
+		http.Error(w, "too many failed attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	c, err := r.Cookie(ceremonyCookieName)
+	if err != nil {
+		http.Error(w, auth.ErrCeremonyExpired.Error(), http.StatusBadRequest)
+		return
+	}
+	hnd.clearCeremonyCookie(w)
+
+	// the attempt was already counted by BeginPasskeyLogin
+	if err := hnd.passkeys.FinishLogin(r.Context(), c.Value, r.Body); err != nil {
+		logger.FromContext(r.Context()).Warn("failed passkey login attempt from %s: %s", ip, err.Error())
+		http.Error(w, "passkey login failed", http.StatusUnauthorized)
+		return
+	}
+	hnd.loginThrottle.Reset(ip)
+
+	if err := hnd.sessions.Create(r.Context(), w); err != nil {
+		logger.FromContext(r.Context()).Error("failed to create admin session: %s", err.Error())
+		http.Error(w, "login is temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	logger.FromContext(r.Context()).Info("admin logged in with a passkey from %s", ip)
+	writeJSON(w, struct {
+		Redirect string `json:"redirect"`
+	}{
+		Redirect: "/admin",
+	})
+}
+
+func (hnd *Handler) AdminRecoveryLogin(w http.ResponseWriter, r *http.Request) {
+	ip := middleware.ClientIP(r)
+	if !hnd.loginAllowed(ip) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		utils.Render(w, r, "views.AdminLogin", views.AdminLogin(hnd.adminLoginProps(r, "Too many failed attempts, try again later.")))
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		utils.Render(w, r, "views.AdminLogin", views.AdminLogin(hnd.adminLoginProps(r, "Invalid request.")))
+		return
+	}
+
+	ok, err := hnd.recoveryCodes.Use(r.Context(), r.PostForm.Get("Code"))
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to check recovery code: %s", err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		utils.Render(w, r, "views.AdminLogin", views.AdminLogin(hnd.adminLoginProps(r, "Login is temporarily unavailable.")))
+		return
+	}
+	if !ok {
+		hnd.loginFailed(ip)
+		logger.FromContext(r.Context()).Warn("failed recovery code login attempt from %s", ip)
+		w.WriteHeader(http.StatusUnauthorized)
+		utils.Render(w, r, "views.AdminLogin", views.AdminLogin(hnd.adminLoginProps(r, "Invalid recovery code.")))
+		return
+	}
+	hnd.loginSucceeded(ip)
+
+	if err := hnd.sessions.Create(r.Context(), w); err != nil {
+		logger.FromContext(r.Context()).Error("failed to create admin session: %s", err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		utils.Render(w, r, "views.AdminLogin", views.AdminLogin(hnd.adminLoginProps(r, "Login is temporarily unavailable.")))
+		return
+	}
+
+	logger.FromContext(r.Context()).Warn("admin logged in with a recovery code from %s", ip)
+	http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+}
+
+func (hnd *Handler) renderAdminSecurity(w http.ResponseWriter, r *http.Request, newCodes []string) {
+	var passkeys []auth.Passkey
+	if hnd.passkeys != nil {
+		var err error
+		passkeys, err = hnd.passkeys.List(r.Context())
+		if err != nil {
+			logger.FromContext(r.Context()).Error("failed to list passkeys: %s", err.Error())
+			http.Error(w, "failed to list passkeys", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	remaining, err := hnd.recoveryCodes.Remaining(r.Context())
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to count recovery codes: %s", err.Error())
+		http.Error(w, "failed to count recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	props := views.AdminSecurityProps{
+		Nav:                    adminNavItems,
+		PasskeysEnabled:        hnd.passkeys != nil,
+		RecoveryCodesRemaining: remaining,
+		NewRecoveryCodes:       newCodes,
+	}
+	for _, pk := range passkeys {
+		lastUsed := "never"
+		if pk.LastUsedAt != nil {
+			lastUsed = pk.LastUsedAt.UTC().Format("2006-01-02 15:04")
+		}
+		props.Passkeys = append(props.Passkeys, views.AdminPasskey{
+			ID:         base64.RawURLEncoding.EncodeToString(pk.ID),
+			Name:       pk.Name,
+			CreatedAt:  pk.CreatedAt.UTC().Format("2006-01-02 15:04"),
+			LastUsedAt: lastUsed,
+		})
+	}
+
+	utils.Render(w, r, "views.AdminSecurity", views.AdminSecurity(props))
+}
+
+func (hnd *Handler) setCeremonyCookie(w http.ResponseWriter, id string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ceremonyCookieName,
+		Value:    id,
+		Path:     "/admin",
+		MaxAge:   int(ceremonyCookieTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   hnd.config.App.Env != "local",
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func (hnd *Handler) clearCeremonyCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ceremonyCookieName,
+		Value:    "",
+		Path:     "/admin",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   hnd.config.App.Env != "local",
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
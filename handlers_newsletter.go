@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/newsletter"
+	"github.com/ip812/blog/status"
+	"github.com/ip812/blog/templates/components"
+	"github.com/ip812/blog/templates/views"
+	"github.com/ip812/blog/utils"
+)
+
+func (hnd *Handler) SubscribeToNewsletter(w http.ResponseWriter, r *http.Request) error {
+	err := r.ParseForm()
+	if err != nil {
+		status.AddToast(w, status.ErrorInternalServerError(status.ErrParsingFrom))
+		return utils.Render(w, r, "components.SubscribeForm", components.SubscribeForm(components.SubscribeFormProps{}))
+	}
+	var props components.SubscribeFormProps
+	err = hnd.formDecoder.Decode(&props, r.Form)
+	if err != nil {
+		status.AddToast(w, status.ErrorInternalServerError(status.ErrDecodingForm))
+		return utils.Render(w, r, "components.SubscribeForm", components.SubscribeForm(components.SubscribeFormProps{}))
+	}
+
+	props.Email = strings.TrimSpace(props.Email)
+	if err := hnd.formValidator.Struct(props); err != nil {
+		status.AddToast(w, status.WarningStatusBadRequest(status.WarnInvalidEmail))
+		return utils.Render(w, r, "components.SubscribeForm", components.SubscribeForm(props))
+	}
+
+	if err := hnd.newsletter.Subscribe(r.Context(), props.Email); err != nil {
+		logger.FromContext(r.Context()).Error("failed to subscribe to the newsletter: %s", err.Error())
+		status.AddToast(w, status.ErrorInternalServerError(status.ErrSubscribeToNewsletter))
+		return utils.Render(w, r, "components.SubscribeForm", components.SubscribeForm(props))
+	}
+
+	return utils.Render(w, r, "components.SubscribeFormSubmitted", components.SubscribeFormSubmitted())
+}
+
+func (hnd *Handler) ConfirmNewsletterView(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		utils.Render(w, r, "views.Message", views.Message("Invalid link", newsletter.ErrInvalidLink.Error()))
+		return
+	}
+
+	err = hnd.newsletter.Confirm(r.Context(), id, r.URL.Query().Get("token"))
+	if errors.Is(err, newsletter.ErrInvalidLink) {
+		utils.Render(w, r, "views.Message", views.Message("Invalid link", err.Error()))
+		return
+	}
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to confirm newsletter subscription: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		utils.Render(w, r, "views.Message", views.Message("Something went wrong", "Please try again later."))
+		return
+	}
+
+	utils.Render(w, r, "views.Message", views.Message("Subscribed", "You will get an email when a new article is out."))
+}
+
+func (hnd *Handler) UnsubscribeFromNewsletterView(w http.ResponseWriter, r *http.Request) {
+	utils.Render(w, r, "views.Unsubscribe", views.Unsubscribe(r.URL.RequestURI(), "You will stop receiving new article emails right away."))
+}
+
+// UnsubscribeFromNewsletter also serves RFC 8058 one-click requests sent by
+// mail clients to the List-Unsubscribe URL.
+func (hnd *Handler) UnsubscribeFromNewsletter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		utils.Render(w, r, "views.Message", views.Message("Invalid link", newsletter.ErrInvalidLink.Error()))
+		return
+	}
+
+	err = hnd.newsletter.Unsubscribe(r.Context(), id, r.URL.Query().Get("token"))
+	if errors.Is(err, newsletter.ErrInvalidLink) {
+		w.WriteHeader(http.StatusBadRequest)
+		utils.Render(w, r, "views.Message", views.Message("Invalid link", err.Error()))
+		return
+	}
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to unsubscribe from the newsletter: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		utils.Render(w, r, "views.Message", views.Message("Something went wrong", "Please try again later."))
+		return
+	}
+
+	utils.Render(w, r, "views.Message", views.Message("Unsubscribed", "You will not receive any more emails from this blog."))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/templates/views"
+	"github.com/ip812/blog/utils"
+)
+
+// commenter returns the username of the signed cookie of r. It renders why
+// nothing can be erased and returns false otherwise.
+func (hnd *Handler) commenter(w http.ResponseWriter, r *http.Request) (string, bool) {
+	c, err := r.Cookie(CookieKey)
+	if err != nil {
+		utils.Render(w, r, "views.Message", views.Message("Nothing to forget", "This browser has not commented on anything."))
+		return "", false
+	}
+
+	username, ok := verifyUsername(hnd.config.App.SecretKey, c.Value)
+	if !ok {
+		// usernames are public, erasing for an unsigned cookie would let
+		// anyone erase the comments of others, so cookies from before
+		// usernames were signed are not trusted either
+		w.WriteHeader(http.StatusForbidden)
+		utils.Render(w, r, "views.Message", views.Message(
+			"Can't verify this browser",
+			"This browser got its username before usernames were signed, so it can't be verified and its comments can't be erased from here. Please ask the author of the blog to erase them, naming the username shown next to them.",
+		))
+		return "", false
+	}
+	return username, true
+}
+
+func (hnd *Handler) ForgetMeView(w http.ResponseWriter, r *http.Request) {
+	username, ok := hnd.commenter(w, r)
+	if !ok {
+		return
+	}
+
+	utils.Render(w, r, "views.ForgetMe", views.ForgetMe(username))
+}
+
+func (hnd *Handler) ForgetMe(w http.ResponseWriter, r *http.Request) {
+	username, ok := hnd.commenter(w, r)
+	if !ok {
+		return
+	}
+
+	erased, err := hnd.privacy.Erase(r.Context(), username)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to erase the data of a commenter: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		utils.Render(w, r, "views.Message", views.Message("Something went wrong", "Please try again later."))
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieKey,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	logger.FromContext(r.Context()).Info("erased %d comments and %d subscriptions on request", erased.Comments, erased.Subscriptions)
+
+	utils.Render(w, r, "views.Message", views.Message(
+		"Forgotten",
+		fmt.Sprintf("Deleted %d comments and %d reply notifications.", erased.Comments, erased.Subscriptions),
+	))
+}
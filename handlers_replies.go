@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/replies"
+	"github.com/ip812/blog/templates/views"
+	"github.com/ip812/blog/utils"
+)
+
+func (hnd *Handler) ConfirmRepliesView(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		utils.Render(w, r, "views.Message", views.Message("Invalid link", replies.ErrInvalidLink.Error()))
+		return
+	}
+
+	err = hnd.replies.Confirm(r.Context(), id, r.URL.Query().Get("token"))
+	if errors.Is(err, replies.ErrInvalidLink) {
+		utils.Render(w, r, "views.Message", views.Message("Invalid link", err.Error()))
+		return
+	}
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to confirm reply notifications: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		utils.Render(w, r, "views.Message", views.Message("Something went wrong", "Please try again later."))
+		return
+	}
+
+	utils.Render(w, r, "views.Message", views.Message("Confirmed", "You will get an email when someone else comments on this article."))
+}
+
+func (hnd *Handler) UnsubscribeFromRepliesView(w http.ResponseWriter, r *http.Request) {
+	utils.Render(w, r, "views.Unsubscribe", views.Unsubscribe(r.URL.RequestURI(), "You will stop receiving emails about new comments on this article."))
+}
+
+func (hnd *Handler) UnsubscribeFromReplies(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		utils.Render(w, r, "views.Message", views.Message("Invalid link", replies.ErrInvalidLink.Error()))
+		return
+	}
+
+	err = hnd.replies.Unsubscribe(r.Context(), id, r.URL.Query().Get("token"))
+	if errors.Is(err, replies.ErrInvalidLink) {
+		w.WriteHeader(http.StatusBadRequest)
+		utils.Render(w, r, "views.Message", views.Message("Invalid link", err.Error()))
+		return
+	}
+	if err != nil {
+		logger.FromContext(r.Context()).Error("failed to unsubscribe from replies: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		utils.Render(w, r, "views.Message", views.Message("Something went wrong", "Please try again later."))
+		return
+	}
+
+	utils.Render(w, r, "views.Message", views.Message("Unsubscribed", "You will not receive any more emails about this article."))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ip812/blog/templates/components"
+	"github.com/ip812/blog/utils"
+)
+
+func (hnd *Handler) GetArticleSuggestions(w http.ResponseWriter, r *http.Request) error {
+	articleID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+
+	return utils.Render(w, r, "components.ArticleSuggestions", components.ArticleSuggestions(
+		hnd.suggestions.Related(articleID),
+		hnd.suggestions.Popular(articleID),
+	))
+}
+
+// renderArticles renders every article to HTML, which is what related
+// articles are computed from.
+func renderArticles(ctx context.Context) (map[uint64]string, error) {
+	pages := make(map[uint64]string, len(articleViews))
+	for id, article := range articleViews {
+		var buf bytes.Buffer
+		if err := article.view().Render(ctx, &buf); err != nil {
+			return nil, err
+		}
+		pages[id] = buf.String()
+	}
+	return pages, nil
+}
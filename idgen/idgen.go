@@ -0,0 +1,286 @@
+// Package idgen mints the snowflake IDs of comments, subscribers and events.
+// Every process needs a machine ID of its own, otherwise two replicas can
+// mint the same ID in the same millisecond, so IDs are refused until one is
+// assigned.
+package idgen
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/godruoyi/go-snowflake"
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtx"
+	"github.com/ip812/blog/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	leaseTTL           = 60 * time.Second
+	leaseRenewInterval = 15 * time.Second
+	// a lease is given up locally this long before it expires in Postgres,
+	// covering the time a renewal takes to reach the database
+	leaseSafetyMargin = 10 * time.Second
+	leaseRetryDelay   = 5 * time.Second
+)
+
+var ErrNoMachineID = errors.New("no snowflake machine ID is assigned")
+
+var (
+	opsMachineID = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "blog_snowflake_machine_id",
+		Help: "Snowflake machine ID of this process, -1 when it has none",
+	})
+	opsLeaseRenewalFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "blog_snowflake_lease_renewal_failures_total",
+		Help: "Total number of failed snowflake machine ID lease renewals",
+	})
+)
+
+func init() {
+	opsMachineID.Set(-1)
+}
+
+type DBProvider interface {
+	DB() (*sql.DB, error)
+}
+
+// Allocator holds the machine ID of this process, either fixed by config or
+// leased from Postgres.
+type Allocator struct {
+	db    DBProvider
+	log   logger.Logger
+	owner string
+
+	mu         sync.RWMutex
+	machineID  int32
+	validUntil time.Time
+}
+
+var current atomic.Pointer[Allocator]
+
+// SetDefault makes a the default allocator, the one used by NextID.
+func SetDefault(a *Allocator) {
+	current.Store(a)
+}
+
+// NextID mints an ID with the machine ID of the default allocator.
+func NextID() (int64, error) {
+	a := current.Load()
+	if a == nil {
+		return 0, ErrNoMachineID
+	}
+	return a.NextID()
+}
+
+// Check tells whether NextID can mint IDs.
+func Check() error {
+	a := current.Load()
+	if a == nil {
+		return ErrNoMachineID
+	}
+	if _, ok := a.MachineID(); !ok {
+		return ErrNoMachineID
+	}
+	return nil
+}
+
+// NewFixed uses machineID for as long as the process runs. The caller is
+// responsible for no other process using the same one.
+func NewFixed(machineID uint16, log logger.Logger) (*Allocator, error) {
+	if machineID > snowflake.MaxMachineID {
+		return nil, errors.New("snowflake machine ID must be between 0 and 1023")
+	}
+
+	log.Info("using snowflake machine ID %d", machineID)
+	opsMachineID.Set(float64(machineID))
+
+	return &Allocator{
+		log:       log,
+		machineID: int32(machineID),
+	}, nil
+}
+
+// NewLeased has no machine ID until Run leased one from the database.
+func NewLeased(db DBProvider, log logger.Logger) *Allocator {
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+
+	return &Allocator{
+		db:        db,
+		log:       log,
+		owner:     hostname + "-" + hex.EncodeToString(suffix),
+		machineID: -1,
+	}
+}
+
+// MachineID returns the machine ID, false while there is no valid one.
+func (a *Allocator) MachineID() (uint16, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.machineID < 0 || (a.db != nil && time.Now().After(a.validUntil)) {
+		return 0, false
+	}
+	return uint16(a.machineID), true
+}
+
+// NextID mints an ID. The snowflake package is left at machine ID 0 and the
+// machine ID is added here, so it can change without a data race.
+func (a *Allocator) NextID() (int64, error) {
+	machineID, ok := a.MachineID()
+	if !ok {
+		return 0, ErrNoMachineID
+	}
+
+	id, err := snowflake.NextID()
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(id | uint64(machineID)<<snowflake.SequenceLength), nil
+}
+
+// Run leases a machine ID and keeps renewing it until ctx is cancelled, then
+// releases it. A lost lease is replaced by a new one. It returns right away
+// for a fixed machine ID.
+func (a *Allocator) Run(ctx context.Context) {
+	if a.db == nil {
+		return
+	}
+	defer a.release()
+
+	for {
+		var wait time.Duration
+		if _, ok := a.MachineID(); ok {
+			wait = leaseRenewInterval
+			a.renew(ctx)
+		} else {
+			wait = leaseRetryDelay
+			if a.acquire(ctx) {
+				wait = leaseRenewInterval
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (a *Allocator) acquire(ctx context.Context) bool {
+	db, err := a.db.DB()
+	if err != nil {
+		return false
+	}
+
+	started := time.Now()
+	machineID, err := database.New(dbtx.Instrument(db)).AcquireSnowflakeLease(ctx, database.AcquireSnowflakeLeaseParams{
+		Owner:        a.owner,
+		TtlSeconds:   int32(leaseTTL.Seconds()),
+		MaxMachineID: int32(snowflake.MaxMachineID),
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		a.log.Warn("no free snowflake machine ID, retrying")
+		return false
+	}
+	if err != nil {
+		a.log.Warn("failed to lease a snowflake machine ID: %s", err.Error())
+		return false
+	}
+
+	a.mu.Lock()
+	a.machineID = machineID
+	a.validUntil = started.Add(leaseTTL - leaseSafetyMargin)
+	a.mu.Unlock()
+
+	a.log.Info("leased snowflake machine ID %d as %s", machineID, a.owner)
+	opsMachineID.Set(float64(machineID))
+	return true
+}
+
+func (a *Allocator) renew(ctx context.Context) {
+	a.mu.RLock()
+	machineID := a.machineID
+	a.mu.RUnlock()
+
+	started := time.Now()
+	n, err := a.renewLease(ctx, machineID)
+	if err != nil {
+		opsLeaseRenewalFailures.Inc()
+		a.log.Warn("failed to renew the lease of snowflake machine ID %d: %s", machineID, err.Error())
+		return
+	}
+	if n == 0 {
+		opsLeaseRenewalFailures.Inc()
+		a.log.Error("lost the lease of snowflake machine ID %d", machineID)
+		a.invalidate()
+		return
+	}
+
+	a.mu.Lock()
+	a.validUntil = started.Add(leaseTTL - leaseSafetyMargin)
+	a.mu.Unlock()
+}
+
+func (a *Allocator) renewLease(ctx context.Context, machineID int32) (int64, error) {
+	db, err := a.db.DB()
+	if err != nil {
+		return 0, err
+	}
+
+	return database.New(dbtx.Instrument(db)).RenewSnowflakeLease(ctx, database.RenewSnowflakeLeaseParams{
+		TtlSeconds: int32(leaseTTL.Seconds()),
+		MachineID:  machineID,
+		Owner:      a.owner,
+	})
+}
+
+func (a *Allocator) invalidate() {
+	a.mu.Lock()
+	a.machineID = -1
+	a.mu.Unlock()
+	opsMachineID.Set(-1)
+}
+
+// release gives the lease back, so a replacement process doesn't have to
+// wait for it to expire.
+func (a *Allocator) release() {
+	a.mu.RLock()
+	machineID := a.machineID
+	a.mu.RUnlock()
+	if machineID < 0 {
+		return
+	}
+
+	a.invalidate()
+
+	db, err := a.db.DB()
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = database.New(dbtx.Instrument(db)).ReleaseSnowflakeLease(ctx, database.ReleaseSnowflakeLeaseParams{
+		MachineID: machineID,
+		Owner:     a.owner,
+	})
+	if err != nil {
+		a.log.Warn("failed to release snowflake machine ID %d: %s", machineID, err.Error())
+		return
+	}
+	a.log.Info("released snowflake machine ID %d", machineID)
+}
@@ -0,0 +1,123 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+)
+
+// levelState is replaced as a whole on every change, so loggers read it
+// without locking.
+type levelState struct {
+	global     zerolog.Level
+	components map[string]zerolog.Level
+}
+
+var (
+	levelsMu sync.Mutex
+	levels   atomic.Pointer[levelState]
+)
+
+func init() {
+	levels.Store(&levelState{global: zerolog.DebugLevel})
+}
+
+func enabled(component string, level zerolog.Level) bool {
+	state := levels.Load()
+	min, ok := state.components[component]
+	if !ok {
+		min = state.global
+	}
+	return level >= min
+}
+
+// SetLevel changes the minimum level of component, or of every component
+// without a level of its own when component is empty. An empty level removes
+// the level of component.
+func SetLevel(component, level string) error {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+
+	state := levels.Load()
+	next := &levelState{
+		global:     state.global,
+		components: maps.Clone(state.components),
+	}
+	if next.components == nil {
+		next.components = map[string]zerolog.Level{}
+	}
+
+	if component != "" && level == "" {
+		delete(next.components, component)
+		levels.Store(next)
+		return nil
+	}
+
+	parsed, err := zerolog.ParseLevel(level)
+	if err != nil || parsed == zerolog.NoLevel {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	if component == "" {
+		next.global = parsed
+	} else {
+		next.components[component] = parsed
+	}
+	levels.Store(next)
+	return nil
+}
+
+// LevelInfo is the minimum level and the levels of single components.
+type LevelInfo struct {
+	Level      string            `json:"level"`
+	Components map[string]string `json:"components"`
+}
+
+func Levels() LevelInfo {
+	state := levels.Load()
+	info := LevelInfo{
+		Level:      state.global.String(),
+		Components: map[string]string{},
+	}
+	for component, level := range state.components {
+		info.Components[component] = level.String()
+	}
+	return info
+}
+
+// LevelHandler reports the log levels on GET and changes one on PUT, e.g.
+// PUT /log/level?level=debug or PUT /log/level?component=outbox&level=warn,
+// reporting the levels in effect afterwards. It changes the levels of this
+// process only.
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			component := r.URL.Query().Get("component")
+			level := r.URL.Query().Get("level")
+			if err := SetLevel(component, level); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if component == "" {
+				FromContext(r.Context()).Warn("log level set to %s at runtime", level)
+			} else if level == "" {
+				FromContext(r.Context()).Warn("log level of %s reset at runtime", component)
+			} else {
+				FromContext(r.Context()).Warn("log level of %s set to %s at runtime", component, level)
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Levels())
+	})
+}
@@ -1,12 +1,15 @@
 package logger
 
 import (
-	"fmt"
+	"context"
+	"io"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/ip812/blog/config"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Logger interface {
@@ -14,74 +17,176 @@ type Logger interface {
 	Info(msg string, args ...interface{})
 	Warn(msg string, args ...interface{})
 	Error(msg string, args ...interface{})
+	// With returns a logger adding the key-value pairs to every line, e.g.
+	// log.With("article_id", id, "username", username).
+	With(keyvals ...interface{}) Logger
+	// Component returns a logger for a part of the app, with a level of its
+	// own when one is set for name.
+	Component(name string) Logger
+	// Sampled returns a logger dropping debug and info lines past the
+	// configured burst, for lines logged on every request.
+	Sampled() Logger
 }
 
+type loggerKey struct{}
+
+type requestIDKey struct{}
+
+// fallback is returned by FromContext for contexts without a logger.
+var fallback atomic.Pointer[Logger]
+
+var sampler atomic.Pointer[zerolog.LevelSampler]
+
+// New returns a logger writing plain text locally and JSON otherwise, and
+// handing every line to OpenTelemetry once o11y.Setup is done. The
+// first one created is used for contexts without a logger. Levels are shared
+// by every logger and can be changed later with SetLevel.
 func New(cfg *config.Config) Logger {
-	var log zerolog.Logger
-	if cfg.App.Env == "local" {
-		log = zerolog.New(zerolog.ConsoleWriter{
-			Out:        os.Stdout,
+	return newLogger(cfg, os.Stdout)
+}
+
+// NewCommand is New writing to stderr, for commands whose stdout is their
+// output, e.g. the archive of export.
+func NewCommand(cfg *config.Config) Logger {
+	return newLogger(cfg, os.Stderr)
+}
+
+func newLogger(cfg *config.Config, w io.Writer) Logger {
+	// levels are checked by the loggers themselves, see enabled
+	zerolog.SetGlobalLevel(zerolog.TraceLevel)
+	zerolog.TimeFieldFormat = time.RFC3339
+	zerolog.TimestampFunc = func() time.Time {
+		return time.Now().UTC()
+	}
+
+	out := w
+	if cfg.App.Env == config.Local {
+		out = zerolog.ConsoleWriter{
+			Out:        w,
 			TimeFormat: time.RFC3339,
-		}).With().Timestamp().Logger().Level(zerolog.InfoLevel)
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-		zerolog.TimeFieldFormat = time.RFC3339
-		zerolog.TimestampFunc = func() time.Time {
-			return time.Now().UTC()
 		}
-		return &LoggerLocal{
-			Log: &log,
+	}
+
+	var log Logger = &zeroLogger{
+		log: zerolog.New(zerolog.MultiLevelWriter(out, newOTelWriter())).With().Timestamp().Logger(),
+	}
+	fallback.CompareAndSwap(nil, &log)
+
+	if err := SetLevel("", cfg.Log.Level); err != nil {
+		log.Warn("%s, using info", err.Error())
+		SetLevel("", zerolog.InfoLevel.String())
+	}
+	for component, level := range cfg.Log.ComponentLevels {
+		if err := SetLevel(component, level); err != nil {
+			log.Warn("%s for %s, ignoring it", err.Error(), component)
 		}
 	}
 
-	log = zerolog.New(os.Stdout).With().Timestamp().Logger()
-	zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	zerolog.TimeFieldFormat = time.RFC3339
-	zerolog.TimestampFunc = func() time.Time {
-		return time.Now().UTC()
+	if cfg.Log.SampleBurst > 0 {
+		burst := &zerolog.BurstSampler{
+			Burst:  uint32(cfg.Log.SampleBurst),
+			Period: cfg.Log.SamplePeriod,
+		}
+		sampler.Store(&zerolog.LevelSampler{
+			DebugSampler: burst,
+			InfoSampler:  burst,
+		})
+	}
+
+	return log
+}
+
+// WithContext returns a copy of ctx carrying log, e.g. to hand a logger
+// with request fields to everything serving the request.
+func WithContext(ctx context.Context, log Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// FromContext returns the logger carried by ctx with the request ID and the
+// trace and span IDs of ctx attached, so log lines can be matched with
+// traces.
+func FromContext(ctx context.Context) Logger {
+	log, ok := ctx.Value(loggerKey{}).(Logger)
+	if !ok {
+		if p := fallback.Load(); p != nil {
+			log = *p
+		} else {
+			log = &zeroLogger{log: zerolog.Nop()}
+		}
+	}
+
+	var keyvals []interface{}
+	if id := RequestID(ctx); id != "" {
+		keyvals = append(keyvals, "request_id", id)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		keyvals = append(keyvals, "trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
 	}
-	return &LoggerProd{
-		Log: &log,
+	if len(keyvals) == 0 {
+		return log
 	}
+	return log.With(keyvals...)
 }
 
-// Logger implementation for local development (plain text)
-type LoggerLocal struct {
-	Log *zerolog.Logger
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
 }
 
-func (l *LoggerLocal) Debug(msg string, args ...interface{}) {
-	l.Log.Debug().Msg(fmt.Sprintf(msg, args...))
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
 }
 
-func (l *LoggerLocal) Info(msg string, args ...interface{}) {
-	l.Log.Info().Msg(fmt.Sprintf(msg, args...))
+type zeroLogger struct {
+	log       zerolog.Logger
+	component string
 }
 
-func (l *LoggerLocal) Warn(msg string, args ...interface{}) {
-	l.Log.Warn().Msg(fmt.Sprintf(msg, args...))
+func (l *zeroLogger) Debug(msg string, args ...interface{}) {
+	if enabled(l.component, zerolog.DebugLevel) {
+		l.log.Debug().Msgf(msg, args...)
+	}
 }
 
-func (l *LoggerLocal) Error(msg string, args ...interface{}) {
-	l.Log.Error().Msg(fmt.Sprintf(msg, args...))
+func (l *zeroLogger) Info(msg string, args ...interface{}) {
+	if enabled(l.component, zerolog.InfoLevel) {
+		l.log.Info().Msgf(msg, args...)
+	}
 }
 
-// Logger implementation for prod (json)
-type LoggerProd struct {
-	Log *zerolog.Logger
+func (l *zeroLogger) Warn(msg string, args ...interface{}) {
+	if enabled(l.component, zerolog.WarnLevel) {
+		l.log.Warn().Msgf(msg, args...)
+	}
 }
 
-func (l *LoggerProd) Debug(msg string, args ...interface{}) {
-	l.Log.Debug().Msg(fmt.Sprintf(msg, args...))
+func (l *zeroLogger) Error(msg string, args ...interface{}) {
+	if enabled(l.component, zerolog.ErrorLevel) {
+		l.log.Error().Msgf(msg, args...)
+	}
 }
 
-func (l *LoggerProd) Info(msg string, args ...interface{}) {
-	l.Log.Info().Msg(fmt.Sprintf(msg, args...))
+func (l *zeroLogger) With(keyvals ...interface{}) Logger {
+	return &zeroLogger{
+		log:       l.log.With().Fields(keyvals).Logger(),
+		component: l.component,
+	}
 }
 
-func (l *LoggerProd) Warn(msg string, args ...interface{}) {
-	l.Log.Warn().Msg(fmt.Sprintf(msg, args...))
+func (l *zeroLogger) Component(name string) Logger {
+	return &zeroLogger{
+		log:       l.log.With().Str("component", name).Logger(),
+		component: name,
+	}
 }
 
-func (l *LoggerProd) Error(msg string, args ...interface{}) {
-	l.Log.Error().Msg(fmt.Sprintf(msg, args...))
+func (l *zeroLogger) Sampled() Logger {
+	s := sampler.Load()
+	if s == nil {
+		return l
+	}
+	return &zeroLogger{
+		log:       l.log.Sample(s),
+		component: l.component,
+	}
 }
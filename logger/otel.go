@@ -0,0 +1,109 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/log/global"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var severities = map[zerolog.Level]otellog.Severity{
+	zerolog.TraceLevel: otellog.SeverityTrace,
+	zerolog.DebugLevel: otellog.SeverityDebug,
+	zerolog.InfoLevel:  otellog.SeverityInfo,
+	zerolog.WarnLevel:  otellog.SeverityWarn,
+	zerolog.ErrorLevel: otellog.SeverityError,
+	zerolog.FatalLevel: otellog.SeverityFatal,
+	zerolog.PanicLevel: otellog.SeverityFatal4,
+}
+
+// otelWriter hands every line to the global OpenTelemetry LoggerProvider,
+// which drops them until o11y.Setup replaced it.
+type otelWriter struct {
+	log otellog.Logger
+}
+
+func newOTelWriter() *otelWriter {
+	return &otelWriter{log: global.GetLoggerProvider().Logger("github.com/ip812/blog")}
+}
+
+func (w *otelWriter) Write(p []byte) (int, error) {
+	return w.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (w *otelWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	ctx := context.Background()
+	severity := severities[level]
+	if !w.log.Enabled(ctx, otellog.EnabledParameters{Severity: severity}) {
+		return len(p), nil
+	}
+
+	// numbers are kept as they are, snowflake IDs don't fit a float64
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		return len(p), nil
+	}
+
+	var rec otellog.Record
+	rec.SetSeverity(severity)
+	rec.SetSeverityText(level.String())
+	rec.SetObservedTimestamp(time.Now())
+
+	var traceID trace.TraceID
+	var spanID trace.SpanID
+	for key, value := range fields {
+		s, _ := value.(string)
+		switch key {
+		case zerolog.MessageFieldName:
+			rec.SetBody(otellog.StringValue(s))
+		case zerolog.LevelFieldName:
+		case zerolog.TimestampFieldName:
+			if t, err := time.Parse(zerolog.TimeFieldFormat, s); err == nil {
+				rec.SetTimestamp(t)
+			}
+		case "trace_id":
+			traceID, _ = trace.TraceIDFromHex(s)
+		case "span_id":
+			spanID, _ = trace.SpanIDFromHex(s)
+		default:
+			rec.AddAttributes(otellog.KeyValue{Key: key, Value: otelValue(value)})
+		}
+	}
+
+	// the IDs are put back into a context, that is where the record takes
+	// them from
+	sc := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID})
+	if sc.IsValid() {
+		ctx = trace.ContextWithSpanContext(ctx, sc)
+	}
+	w.log.Emit(ctx, rec)
+
+	return len(p), nil
+}
+
+func otelValue(value interface{}) otellog.Value {
+	switch v := value.(type) {
+	case string:
+		return otellog.StringValue(v)
+	case bool:
+		return otellog.BoolValue(v)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return otellog.Int64Value(n)
+		}
+		if f, err := v.Float64(); err == nil {
+			return otellog.Float64Value(f)
+		}
+		return otellog.StringValue(v.String())
+	default:
+		return otellog.StringValue(fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,60 @@
+package mailer_test
+
+import (
+	"context"
+	"mime"
+	"testing"
+	"time"
+
+	"github.com/ip812/blog/mailer"
+	"github.com/ip812/blog/mailer/mailertest"
+)
+
+func TestSMTPMailerSend(t *testing.T) {
+	sink := mailertest.NewSink(t)
+	m := mailer.NewSMTP(sink.Config())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.Send(ctx, mailer.Message{
+		To:      "reader@example.com",
+		Subject: "Нова статия",
+		Body:    "Hi,\n\na new article is out.\n",
+		Headers: map[string]string{"List-Unsubscribe": "<https://example.com/unsubscribe>"},
+	})
+	if err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+
+	messages := sink.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("sink got %d messages, want 1", len(messages))
+	}
+	got := messages[0]
+
+	if got.From != "blog@example.com" {
+		t.Errorf("from = %q, want blog@example.com", got.From)
+	}
+	if len(got.To) != 1 || got.To[0] != "reader@example.com" {
+		t.Errorf("to = %v, want [reader@example.com]", got.To)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(got.Header.Get("Subject"))
+	if err != nil || subject != "Нова статия" {
+		t.Errorf("subject = %q (%v), want Нова статия", subject, err)
+	}
+	if v := got.Header.Get("List-Unsubscribe"); v != "<https://example.com/unsubscribe>" {
+		t.Errorf("List-Unsubscribe = %q", v)
+	}
+	if got.Body != "Hi,\n\na new article is out.\n" {
+		t.Errorf("body = %q", got.Body)
+	}
+}
+
+func TestSMTPMailerSendFailsWithoutServer(t *testing.T) {
+	m := mailer.NewSMTP(mailer.SMTPConfig{Host: "127.0.0.1", Port: "1", From: "blog@example.com"})
+
+	if err := m.Send(context.Background(), mailer.Message{To: "reader@example.com"}); err == nil {
+		t.Fatal("expected sending without a server to fail")
+	}
+}
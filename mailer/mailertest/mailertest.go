@@ -0,0 +1,151 @@
+// Package mailertest runs a local SMTP sink, so code sending mail through
+// mailer.SMTPMailer can be tested without a real server.
+package mailertest
+
+import (
+	"bufio"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ip812/blog/mailer"
+)
+
+// Message is a mail accepted by the sink.
+type Message struct {
+	From   string
+	To     []string
+	Header mail.Header
+	Body   string
+}
+
+type Sink struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	messages []Message
+}
+
+// NewSink listens on a random local port until t is done.
+func NewSink(t testing.TB) *Sink {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the smtp sink: %s", err)
+	}
+	s := &Sink{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+
+	go s.serve()
+	return s
+}
+
+// Config returns the settings for a mailer sending to the sink.
+func (s *Sink) Config() mailer.SMTPConfig {
+	host, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	return mailer.SMTPConfig{
+		Host: host,
+		Port: port,
+		From: "blog@example.com",
+	}
+}
+
+// Messages returns the mails accepted so far.
+func (s *Sink) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+func (s *Sink) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle speaks just enough SMTP for net/smtp: no extensions, no auth and
+// one message per MAIL command.
+func (s *Sink) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	var msg Message
+	reply("220 localhost ESMTP sink")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "MAIL":
+			msg = Message{From: address(arg)}
+			reply("250 OK")
+		case "RCPT":
+			msg.To = append(msg.To, address(arg))
+			reply("250 OK")
+		case "DATA":
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			data, err := readData(r)
+			if err != nil {
+				return
+			}
+			parsed, err := mail.ReadMessage(strings.NewReader(data))
+			if err != nil {
+				reply("554 " + err.Error())
+				continue
+			}
+			var body strings.Builder
+			bufio.NewReader(parsed.Body).WriteTo(&body)
+			msg.Header = parsed.Header
+			msg.Body = strings.ReplaceAll(body.String(), "\r\n", "\n")
+
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			reply("250 OK")
+		case "RSET", "NOOP":
+			reply("250 OK")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func readData(r *bufio.Reader) (string, error) {
+	var b strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if line == ".\r\n" {
+			return b.String(), nil
+		}
+		b.WriteString(strings.TrimPrefix(line, "."))
+	}
+}
+
+// address extracts the address of "FROM:<a@b>" and "TO:<a@b>".
+func address(arg string) string {
+	_, addr, _ := strings.Cut(arg, ":")
+	return strings.Trim(strings.TrimSpace(addr), "<>")
+}
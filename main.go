@@ -6,7 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,67 +19,238 @@ import (
 	"github.com/go-playground/form"
 	"github.com/go-playground/validator/v10"
 	"github.com/godruoyi/go-snowflake"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/riandyrn/otelchi"
+	"go.opentelemetry.io/otel/metric"
 	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
 	oteltrace "go.opentelemetry.io/otel/trace"
 
 	_ "github.com/lib/pq"
-	"github.com/pressly/goose/v3"
 
+	"github.com/ip812/blog/analytics"
+	"github.com/ip812/blog/auth"
 	"github.com/ip812/blog/config"
+	"github.com/ip812/blog/dbtx"
+	"github.com/ip812/blog/idgen"
 	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/mailer"
 	"github.com/ip812/blog/middleware"
+	"github.com/ip812/blog/newsletter"
 	"github.com/ip812/blog/o11y"
+	"github.com/ip812/blog/outbox"
+	"github.com/ip812/blog/privacy"
+	"github.com/ip812/blog/replies"
+	"github.com/ip812/blog/scheduler"
+	"github.com/ip812/blog/secure"
+	"github.com/ip812/blog/slack"
+	"github.com/ip812/blog/store"
+	"github.com/ip812/blog/suggestions"
 	"github.com/ip812/blog/utils"
 )
 
 const (
 	serviceName           = "blog"
 	dbConnectTimeout      = 10 * time.Second
-	dbMaxOpenConnections  = 10
 	retryMaxElapsedTime   = 15 * time.Minute
 	serverIdleTimeout     = 1 * time.Minute
 	serverReadTimeout     = 10 * time.Second
 	serverWriteTimeout    = 30 * time.Second
 	serverShutdownTimeout = 10 * time.Second
+	telemetryFlushTimeout = 5 * time.Second
+	adminLoginMaxFailures = 5
+	adminLoginWindow      = 15 * time.Minute
+	// failures from all addresses together before the password and
+	// recovery codes are locked for the rest of the window
+	adminAccountMaxFailures = 50
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
 	cfg := config.New()
 	log := logger.New(cfg)
-	tracer, err := o11y.NewTracer(serviceName)
-	if err != nil {
-		log.Error("unable to initialize tracer due: %v", err)
+	if err := cfg.Validate(); err != nil {
+		log.Error("exiting: %s", err.Error())
+		return
+	}
+	dbtx.SetQueryTimeout(cfg.Database.QueryTimeout)
+	swappableDB := NewSwappableDB()
+	readiness := NewReadiness(swappableDB)
+	var comments store.CommentStore = store.NewPostgres(swappableDB)
+
+	// only comments are kept in SQLite, the services needing Postgres are
+	// not started and their routes answer 404, see requirePostgres
+	var sqliteDB *sql.DB
+	if cfg.Database.Driver == config.DriverSQLite {
+		db, err := openSQLite(ctx, cfg.Database.SQLitePath)
+		if err != nil {
+			log.Error("exiting: could not open %s: %s", cfg.Database.SQLitePath, err.Error())
+			return
+		}
+		defer db.Close()
+
+		commentsDB := NewSwappableDB()
+		commentsDB.Swap(db)
+		readiness = NewReadiness(commentsDB)
+		comments = store.NewSQLite(db)
+		sqliteDB = db
+	}
+
+	var privacyDB privacy.DBProvider = swappableDB
+	if sqliteDB != nil {
+		privacyDB = nil
+	}
+	privacyService := privacy.New(comments, privacyDB, log.Component("privacy"), privacy.Retention{
+		PageViews:    cfg.Retention.PageViews,
+		OutboxEvents: cfg.Retention.OutboxEvents,
+	})
+
+	jobs := scheduler.New(swappableDB, log.Component("scheduler"))
+	if err := jobs.Register("retention-purge", "0 */6 * * *", privacyService.Purge); err != nil {
+		log.Error("exiting: %s", err.Error())
+		return
+	}
+	schedulerDone := make(chan struct{})
+
+	tracer, shutdownO11y, err := o11y.Setup(ctx, serviceName, o11y.Options{
+		Disabled:         cfg.O11y.Disabled,
+		TraceSampleRatio: cfg.O11y.TraceSampleRatio,
+	})
+	switch {
+	case err != nil:
+		log.Error("unable to initialize telemetry due: %v", err)
+		readiness.SetTelemetry(TelemetryNoop)
+	case cfg.O11y.Disabled:
+		log.Warn("telemetry is disabled, nothing is exported over OTLP")
+		readiness.SetTelemetry(TelemetryDisabled)
+	default:
+		readiness.SetTelemetry(TelemetryOK)
 	}
 
 	// https://snowsta.mp
 	startTime, _ := time.Parse(time.RFC3339, "2015-01-01T00:00:00Z")
 	snowflake.SetStartTime(startTime)
-	snowflake.SetMachineID(1)
+	ids, err := newIDAllocator(cfg, swappableDB, sqliteDB != nil, log.Component("idgen"))
+	if err != nil {
+		log.Error("exiting: %s", err.Error())
+		return
+	}
+	idgen.SetDefault(ids)
+	// the lease is released after the API server has stopped minting IDs
+	idsCtx, stopIDs := context.WithCancel(context.Background())
+	idsDone := make(chan struct{})
+	go func() {
+		ids.Run(idsCtx)
+		close(idsDone)
+	}()
 
-	swappableDB := NewSwappableDB()
+	var mail mailer.Mailer = mailer.NewLogMailer(log.Component("mailer"))
+	if cfg.SMTP.Host != "" {
+		mail = mailer.NewSMTP(mailer.SMTPConfig{
+			Host:     cfg.SMTP.Host,
+			Port:     cfg.SMTP.Port,
+			Username: cfg.SMTP.Username,
+			Password: cfg.SMTP.Password,
+			From:     cfg.SMTP.From,
+		})
+	} else {
+		log.Warn("SMTP is not configured, emails will only be logged")
+	}
+	newsletterService := newsletter.New(swappableDB, mail, log.Component("newsletter"), cfg.BaseURL(), cfg.App.SecretKey)
 
-	apiServer := startHTTPServer(cfg, log, tracer, swappableDB)
-	metricsServer := startMetricsServer(cfg, log)
+	cipher, err := secure.NewCipher(cfg.App.EncryptionKey)
+	if err != nil {
+		log.Error("reply notifications are disabled: %s", err.Error())
+		cipher = nil
+	}
+	repliesService := replies.New(swappableDB, mail, cipher, log.Component("replies"), cfg.BaseURL(), cfg.App.SecretKey)
+
+	// page views are flushed after the API server has stopped taking requests
+	recorder := analytics.New(swappableDB, log.Component("analytics"))
+	analyticsCtx, stopAnalytics := context.WithCancel(context.Background())
+	analyticsDone := make(chan struct{})
+	if sqliteDB == nil {
+		go func() {
+			recorder.Run(analyticsCtx)
+			close(analyticsDone)
+		}()
+	} else {
+		close(analyticsDone)
+	}
 
-	db, err := connectToDatabaseWithRetry(ctx, cfg, log)
+	pages, err := renderArticles(ctx)
 	if err != nil {
-		log.Error("exiting: could not connect to DB after retries: %s", err.Error())
-		return
+		log.Error("failed to render articles for suggestions: %s", err.Error())
+	}
+	// related articles need no database, popular ones are only loaded from
+	// the page views in Postgres
+	suggestionsService := suggestions.New(swappableDB, log.Component("suggestions"), pages)
+	if sqliteDB == nil {
+		go suggestionsService.Run(ctx)
 	}
-	defer db.Close()
 
-	swappableDB.Swap(db)
+	apiServer := startHTTPServer(cfg, log, tracer, swappableDB, newsletterService, repliesService, recorder, suggestionsService, readiness, comments, privacyService, jobs)
+	metricsServer := startMetricsServer(cfg, log)
 
-	if err := goose.SetDialect("postgres"); err != nil {
-		log.Error("failed to set dialect: %s", err.Error())
+	// like page views, deliveries are let finish once the API server has
+	// stopped taking requests
+	dispatcher := outbox.NewDispatcher(swappableDB, log.Component("outbox"))
+	dispatcherCtx, stopDispatcher := context.WithCancel(context.Background())
+	dispatcherDone := make(chan struct{})
+	newsletterService.Register(dispatcher)
+	repliesService.Register(dispatcher)
+	if cfg.Slack.BlogBotToken != "" && cfg.Slack.GeneralChannelID != "" {
+		dispatcher.Register(
+			outbox.EventCommentCreated,
+			"slack",
+			newCommentSlackNotifier(slack.New(cfg.Slack.BlogBotToken), cfg.Slack.GeneralChannelID),
+		)
 	}
-	if err := goose.Up(db, "sql/migrations"); err != nil {
-		log.Error("failed to run migrations: %s", err.Error())
+
+	if sqliteDB != nil {
+		if migrateSQLite(ctx, cfg, log, sqliteDB) {
+			readiness.SetMigrated()
+		}
+		log.Warn("running on SQLite, only articles and comments are available")
+		close(schedulerDone)
+		close(dispatcherDone)
+	} else {
+		conn, err := connectToDatabaseWithRetry(ctx, cfg, log)
+		if err != nil {
+			log.Error("exiting: could not connect to DB after retries: %s", err.Error())
+			return
+		}
+
+		swappableDB.Swap(conn.db)
+		swappableDB.SetReplicas(openReplicas(cfg, log))
+		go func() {
+			dispatcher.Run(dispatcherCtx)
+			close(dispatcherDone)
+		}()
+		supervisor := NewDBSupervisor(swappableDB, conn, cfg, log.Component("database"))
+		defer supervisor.Close()
+		go supervisor.Run(ctx)
+		go func() {
+			jobs.Run(ctx)
+			close(schedulerDone)
+		}()
+
+		if migrateDatabase(cfg, log, conn.db) {
+			readiness.SetMigrated()
+			if err := newsletterService.AnnounceNewArticles(ctx); err != nil {
+				log.Error("failed to announce new articles: %s", err.Error())
+			}
+		}
 	}
 
 	<-ctx.Done()
@@ -89,76 +263,174 @@ func main() {
 	} else {
 		log.Info("server shutdown cleanly")
 	}
+	stopAnalytics()
+	<-analyticsDone
+	stopDispatcher()
+	<-dispatcherDone
+	<-schedulerDone
+	stopIDs()
+	<-idsDone
 
 	if err := metricsServer.Shutdown(shutdownCtx); err != nil {
 		log.Error("error shutting down server: %s", err.Error())
 	} else {
 		log.Info("metrics server shutdown cleanly")
 	}
+
+	// last, so the spans, metrics and logs of the shutdown are exported too,
+	// with a timeout of its own as draining the servers may have used up
+	// shutdownCtx
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), telemetryFlushTimeout)
+	defer cancelFlush()
+	if err := shutdownO11y(flushCtx); err != nil {
+		log.Error("error flushing telemetry: %s", err.Error())
+	}
 }
 
 type dbConnection struct {
-	db *sql.DB
+	db    *sql.DB
+	dsn   string
+	stats metric.Registration
 }
 
-func connectToDatabaseWithRetry(ctx context.Context, cfg *config.Config, log logger.Logger) (*sql.DB, error) {
-	var conn dbConnection
+// Close stops reporting the pool metrics and closes the pool, waiting for
+// queries that already started to finish.
+func (c dbConnection) Close() error {
+	if c.stats != nil {
+		c.stats.Unregister()
+	}
+	return c.db.Close()
+}
+
+// openDatabase creates a pool for dsn without connecting to it yet.
+func openDatabase(cfg *config.Config, dsn string) (dbConnection, error) {
+	db, err := otelsql.Open(
+		"postgres",
+		dsn,
+		otelsql.WithAttributes(
+			semconv.DBSystemNamePostgreSQL,
+		),
+	)
+	if err != nil {
+		return dbConnection{}, err
+	}
 
-	connectionString := fmt.Sprintf(
-		"postgres://%s:%s@%s/%s?sslmode=%s",
-		cfg.Database.Username,
-		cfg.Database.Password,
-		cfg.Database.Endpoint,
-		cfg.Database.Name,
-		cfg.Database.SSLMode,
+	stats, err := otelsql.RegisterDBStatsMetrics(
+		db,
+		otelsql.WithAttributes(
+			semconv.DBSystemNamePostgreSQL,
+		),
 	)
+	if err != nil {
+		db.Close()
+		return dbConnection{}, err
+	}
+
+	db.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.Database.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.Database.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.Database.ConnMaxIdleTime)
+
+	return dbConnection{
+		db:    db,
+		dsn:   dsn,
+		stats: stats,
+	}, nil
+}
+
+func connectToDatabaseWithRetry(ctx context.Context, cfg *config.Config, log logger.Logger) (dbConnection, error) {
+	var conn dbConnection
+
+	connectionString, err := cfg.DatabaseURL(cfg.Database.Endpoint)
+	if err != nil {
+		return conn, err
+	}
 
 	operation := func() (dbConnection, error) {
 		connCtx, cancel := context.WithTimeout(ctx, dbConnectTimeout)
 		defer cancel()
 
-		db, err := otelsql.Open(
-			"postgres",
-			connectionString,
-			otelsql.WithAttributes(
-				semconv.DBSystemNamePostgreSQL,
-			),
-		)
+		c, err := openDatabase(cfg, connectionString)
 		if err != nil {
 			log.Warn("failed to open the database connection: %v", err.Error())
 			return conn, err
 		}
 
-		_, err = otelsql.RegisterDBStatsMetrics(
-			db,
-			otelsql.WithAttributes(
-				semconv.DBSystemNamePostgreSQL,
-			),
-		)
-		if err != nil {
-			log.Warn("failed to register database metrics: %v", err.Error())
-			return conn, err
-		}
-
-		if err := db.PingContext(connCtx); err != nil {
+		if err := c.db.PingContext(connCtx); err != nil {
 			log.Warn("failed to ping the database: %v", err.Error())
+			c.Close()
 			return conn, err
 		}
 
-		db.SetMaxOpenConns(dbMaxOpenConnections)
 		log.Info("connected to database")
 
-		conn.db = db
+		conn = c
 		return conn, nil
 	}
 
-	_, err := backoff.Retry[dbConnection](
+	_, err = backoff.Retry[dbConnection](
 		ctx,
 		operation,
 		backoff.WithMaxElapsedTime(retryMaxElapsedTime),
 	)
 
-	return conn.db, err
+	return conn, err
+}
+
+// openReplicas creates a pool for every configured read replica. They start
+// out unhealthy and receive reads once the supervisor reached them.
+func openReplicas(cfg *config.Config, log logger.Logger) []*replica {
+	replicas := make([]*replica, 0, len(cfg.Database.ReplicaEndpoints))
+	for _, endpoint := range cfg.Database.ReplicaEndpoints {
+		dsn, err := cfg.DatabaseURL(endpoint)
+		if err != nil {
+			log.Warn("skipping read replica %s: %s", endpoint, err.Error())
+			continue
+		}
+		conn, err := openDatabase(cfg, dsn)
+		if err != nil {
+			log.Warn("skipping read replica %s: %s", endpoint, err.Error())
+			continue
+		}
+		replicas = append(replicas, &replica{endpoint: endpoint, conn: conn})
+	}
+	return replicas
+}
+
+// newIDAllocator assigns the snowflake machine ID as configured. On SQLite
+// there is a single process, and machine ID 1 is used unless configured.
+func newIDAllocator(cfg *config.Config, db *SwappableDB, sqlite bool, log logger.Logger) (*idgen.Allocator, error) {
+	value := cfg.App.SnowflakeMachineID
+	switch {
+	case value == "" && sqlite:
+		return idgen.NewFixed(1, log)
+	case value == "":
+		return idgen.NewLeased(db, log), nil
+	case value == "ordinal":
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		// StatefulSet pods are named <name>-<ordinal>
+		value = hostname[strings.LastIndex(hostname, "-")+1:]
+	}
+
+	machineID, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snowflake machine ID %q", value)
+	}
+	return idgen.NewFixed(uint16(machineID), log)
+}
+
+// requirePostgres answers 404 for the routes of features kept in Postgres
+// when running on SQLite, instead of failing on every request.
+func requirePostgres(cfg *config.Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if cfg.Database.Driver == config.DriverPostgres {
+			return next
+		}
+		return http.NotFoundHandler()
+	}
 }
 
 func startHTTPServer(
@@ -166,29 +438,84 @@ func startHTTPServer(
 	log logger.Logger,
 	tracer oteltrace.Tracer,
 	db DBWrapper,
+	newsletterService *newsletter.Service,
+	repliesService *replies.Service,
+	recorder *analytics.Recorder,
+	suggestionsService *suggestions.Service,
+	readiness *Readiness,
+	comments store.CommentStore,
+	privacyService *privacy.Service,
+	jobs *scheduler.Scheduler,
 ) *http.Server {
 	formDecoder := form.NewDecoder()
 	formValidator := validator.New(validator.WithRequiredStructEnabled())
 
+	credentials, err := auth.NewCredentials(cfg.Admin.PasswordHash, cfg.Admin.TOTPSecret)
+	if err != nil {
+		log.Warn("admin area is disabled: %s", err.Error())
+		credentials = nil
+	}
+
+	passkeys, err := auth.NewPasskeys(db, cfg.App.Domain, cfg.BaseURL())
+	if err != nil {
+		log.Warn("passkey login is disabled: %s", err.Error())
+		passkeys = nil
+	}
+
 	handler := Handler{
-		config:        cfg,
-		formDecoder:   formDecoder,
-		formValidator: formValidator,
-		tracer:        tracer,
-		db:            db,
-		log:           log,
+		config:          cfg,
+		formDecoder:     formDecoder,
+		formValidator:   formValidator,
+		tracer:          tracer,
+		db:              db,
+		log:             log,
+		newsletter:      newsletterService,
+		replies:         repliesService,
+		credentials:     credentials,
+		sessions:        auth.NewSessions(db, cfg.App.Env != config.Local),
+		loginThrottle:   auth.NewThrottle(adminLoginMaxFailures, adminLoginWindow),
+		accountThrottle: auth.NewThrottle(adminAccountMaxFailures, adminLoginWindow),
+		passkeys:        passkeys,
+		recoveryCodes:   auth.NewRecoveryCodes(db),
+		suggestions:     suggestionsService,
+		readiness:       readiness,
+		comments:        comments,
+		privacy:         privacyService,
+		scheduler:       jobs,
 	}
 
 	mux := chi.NewRouter()
 	mux.Use(otelchi.Middleware(serviceName, otelchi.WithChiRoutes(mux)))
 	mux.Use(middleware.TraceIDHeaderMiddleware)
+	mux.Use(middleware.ClientIPMiddleware(cfg.App.TrustedProxies))
+	mux.Use(middleware.RequestIDMiddleware(log.Component("http")))
+	mux.Use(middleware.MetricsMiddleware)
+	mux.Use(PrimaryReadsMiddleware)
+	onPostgres := requirePostgres(cfg)
 	mux.Handle("/static/*", handler.StaticFiles())
 	mux.With().Route("/p", func(mux chi.Router) {
 		mux.Route("/public", func(mux chi.Router) {
+			if cfg.Database.Driver == config.DriverPostgres {
+				mux.Use(recorder.Middleware)
+			}
 			mux.Get("/landing-page", handler.LandingPageView)
 			mux.Get("/articles", handler.ArticlesView)
 			mux.Get("/articles/{id}", handler.ArticleDetailsView)
 			mux.Get("/projects", handler.ProjectsView)
+			mux.Get("/forget-me", handler.ForgetMeView)
+			mux.Post("/forget-me", handler.ForgetMe)
+			mux.Route("/newsletter", func(mux chi.Router) {
+				mux.Use(onPostgres)
+				mux.Get("/confirm", handler.ConfirmNewsletterView)
+				mux.Get("/unsubscribe", handler.UnsubscribeFromNewsletterView)
+				mux.Post("/unsubscribe", handler.UnsubscribeFromNewsletter)
+			})
+			mux.Route("/comments", func(mux chi.Router) {
+				mux.Use(onPostgres)
+				mux.Get("/confirm", handler.ConfirmRepliesView)
+				mux.Get("/unsubscribe", handler.UnsubscribeFromRepliesView)
+				mux.Post("/unsubscribe", handler.UnsubscribeFromReplies)
+			})
 		})
 	})
 
@@ -197,11 +524,41 @@ func startHTTPServer(
 			mux.Route("/articles", func(mux chi.Router) {
 				mux.Post("/{id}/comments", utils.MakeTemplHandler(handler.CreateComment))
 				mux.Get("/{id}/comments", utils.MakeTemplHandler(handler.GetAllCommentsByArticleID))
+				mux.Get("/{id}/suggestions", utils.MakeTemplHandler(handler.GetArticleSuggestions))
 			})
+			mux.With(onPostgres).Post("/newsletter/subscribers", utils.MakeTemplHandler(handler.SubscribeToNewsletter))
+		})
+	})
+
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(onPostgres)
+		mux.Get("/login", handler.AdminLoginView)
+		mux.Post("/login", handler.AdminLogin)
+		mux.Post("/login/recovery", handler.AdminRecoveryLogin)
+		mux.Post("/logout", handler.AdminLogout)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(handler.RequireAdmin)
+			mux.Get("/", handler.AdminDashboardView)
+			mux.Get("/security", handler.AdminSecurityView)
+			mux.Get("/analytics", handler.AdminAnalyticsView)
+			mux.Get("/jobs", handler.AdminJobsView)
+			mux.Post("/recovery-codes", handler.GenerateRecoveryCodes)
 		})
+		if handler.passkeys != nil {
+			mux.Post("/login/passkey/begin", handler.BeginPasskeyLogin)
+			mux.Post("/login/passkey/finish", handler.FinishPasskeyLogin)
+			mux.Group(func(mux chi.Router) {
+				mux.Use(handler.RequireAdmin)
+				mux.Post("/passkeys/register/begin", handler.BeginPasskeyRegistration)
+				mux.Post("/passkeys/register/finish", handler.FinishPasskeyRegistration)
+				mux.Post("/passkeys/{id}/delete", handler.DeletePasskey)
+			})
+		}
 	})
 
-	mux.Get("/healthz", handler.Healthz)
+	mux.Get("/healthz", handler.Livez)
+	mux.Get("/livez", handler.Livez)
+	mux.Get("/readyz", handler.Readyz)
 	mux.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/p/public/landing-page", http.StatusFound)
 	})
@@ -230,7 +587,12 @@ func startMetricsServer(
 ) *http.Server {
 	mux := chi.NewRouter()
 
-	mux.Handle("/metrics", promhttp.Handler())
+	// OpenMetrics is needed for the trace exemplars of the HTTP metrics
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+	))
+	mux.Handle("/log/level", logger.LevelHandler())
 
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%s", cfg.App.MetricsPort),
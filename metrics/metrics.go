@@ -0,0 +1,68 @@
+// Package metrics holds the Prometheus metrics of the blog that aren't owned
+// by a single package. Label values must come from a bounded set, e.g. known
+// article IDs or route patterns, never from raw user input.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// UnknownArticle labels article IDs that don't belong to an article.
+const UnknownArticle = "unknown"
+
+// Reasons a comment is rejected for.
+const (
+	RejectInvalidArticle = "invalid_article"
+	RejectInvalidForm    = "invalid_form"
+	RejectInvalidEmail   = "invalid_email"
+	RejectNoReplyEmails  = "no_reply_emails"
+	RejectUnavailable    = "unavailable"
+	RejectError          = "error"
+)
+
+var (
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_http_requests_total",
+		Help: "Total number of HTTP requests by route, method and status class",
+	}, []string{"route", "method", "status"})
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "blog_http_request_duration_seconds",
+		Help:    "Duration of HTTP requests by route, method and status class",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+	HTTPRequestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "blog_http_requests_in_flight",
+		Help: "Number of HTTP requests being served",
+	})
+
+	CommentsCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_comments_created_total",
+		Help: "Total number of comments created by article",
+	}, []string{"article"})
+	CommentsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_comments_rejected_total",
+		Help: "Total number of comments not created by article and reason",
+	}, []string{"article", "reason"})
+	ArticleViews = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_article_views_total",
+		Help: "Total number of article views by article",
+	}, []string{"article"})
+
+	Toasts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_toasts_total",
+		Help: "Total number of toasts shown by status code and error",
+	}, []string{"status", "error"})
+	RenderFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_render_failures_total",
+		Help: "Total number of components that failed to render by route",
+	}, []string{"route"})
+	OutboxEventsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_outbox_events_failed_total",
+		Help: "Total number of outbox events given up on after too many attempts by type",
+	}, []string{"type"})
+	DBErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_db_errors_total",
+		Help: "Total number of failed database queries by query name",
+	}, []string{"query"})
+)
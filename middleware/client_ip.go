@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// ClientIPMiddleware finds the address of the client behind the proxies in
+// trusted, so per-client limits and counts don't see the ingress as the
+// only client. X-Forwarded-For is read from the right, every hop added by a
+// trusted proxy is skipped and the first other one is the client. The
+// header is ignored for requests not coming from a trusted proxy, as anyone
+// can send it.
+func ClientIPMiddleware(trusted []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r, trusted)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+		})
+	}
+}
+
+// ClientIP returns the address found by ClientIPMiddleware, or the peer
+// address of the connection when the middleware didn't run.
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	peer := remoteIP(r)
+	if !isTrusted(peer, trusted) {
+		return peer
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		addr, err := netip.ParseAddr(hop)
+		if err != nil {
+			// a malformed hop can't be told apart from a forged one, so
+			// the last trusted address stands for the client
+			return peer
+		}
+		if !isTrusted(hop, trusted) {
+			return addr.Unmap().String()
+		}
+		peer = hop
+	}
+	return peer
+}
+
+func isTrusted(ip string, trusted []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.1/32"),
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{
+			name:       "direct client",
+			remoteAddr: "203.0.113.7:51234",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "header from an untrusted peer is ignored",
+			remoteAddr: "203.0.113.7:51234",
+			forwarded:  []string{"198.51.100.1"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "client behind the ingress",
+			remoteAddr: "10.1.2.3:80",
+			forwarded:  []string{"198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "spoofed hops left of the client are ignored",
+			remoteAddr: "10.1.2.3:80",
+			forwarded:  []string{"1.1.1.1, 198.51.100.1, 192.168.1.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "headers sent more than once are joined",
+			remoteAddr: "10.1.2.3:80",
+			forwarded:  []string{"1.1.1.1", "198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "malformed hop",
+			remoteAddr: "10.1.2.3:80",
+			forwarded:  []string{"198.51.100.1, bogus"},
+			want:       "10.1.2.3",
+		},
+		{
+			name:       "only trusted hops",
+			remoteAddr: "10.1.2.3:80",
+			forwarded:  []string{"10.9.9.9"},
+			want:       "10.9.9.9",
+		},
+		{
+			name:       "ipv6 client",
+			remoteAddr: "10.1.2.3:80",
+			forwarded:  []string{"2001:db8::1"},
+			want:       "2001:db8::1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+
+			var got string
+			ClientIPMiddleware(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = ClientIP(r)
+			})).ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/metrics"
+)
+
+// requests served by no route share one label, so scanners probing random
+// paths can't blow up the number of series
+const unmatchedRoute = "unmatched"
+
+// MetricsMiddleware records the rate, errors and duration of requests by chi
+// route pattern, with the trace ID as exemplar, and logs one line per
+// request. It has to run after RequestIDMiddleware to log with its logger.
+// Only that line is sampled, what handlers log is kept in full.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		metrics.HTTPRequestsInFlight.Inc()
+		defer metrics.HTTPRequestsInFlight.Dec()
+
+		ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		duration := time.Since(started)
+
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		route := unmatchedRoute
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		labels := prometheus.Labels{
+			"route":  route,
+			"method": r.Method,
+			"status": strconv.Itoa(code/100) + "xx",
+		}
+
+		var exemplar prometheus.Labels
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsSampled() {
+			exemplar = prometheus.Labels{"trace_id": sc.TraceID().String()}
+		}
+		metrics.HTTPRequests.With(labels).(prometheus.ExemplarAdder).AddWithExemplar(1, exemplar)
+		metrics.HTTPRequestDuration.With(labels).(prometheus.ExemplarObserver).ObserveWithExemplar(duration.Seconds(), exemplar)
+
+		log := logger.FromContext(r.Context()).Sampled().With(
+			"method", r.Method,
+			"route", route,
+			"path", r.URL.Path,
+			"status", code,
+			"bytes", ww.BytesWritten(),
+			"duration_ms", duration.Milliseconds(),
+		)
+		if code >= http.StatusInternalServerError {
+			log.Warn("request failed")
+		} else {
+			log.Info("request served")
+		}
+	})
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/ip812/blog/logger"
+)
+
+const RequestIDHeader = "X-Request-Id"
+
+// incoming IDs are only kept when they can't be used to forge log lines
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestIDMiddleware tags every request with an ID, the one sent by the
+// proxy in front of the blog if there is one, and hands a logger to the
+// handlers through the request context, so logger.FromContext adds the
+// request, trace and span IDs to their log lines.
+func RequestIDMiddleware(log logger.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if !requestIDPattern.MatchString(id) {
+				b := make([]byte, 8)
+				rand.Read(b)
+				id = hex.EncodeToString(b)
+			}
+			w.Header().Set(RequestIDHeader, id)
+
+			ctx := logger.WithRequestID(r.Context(), id)
+			ctx = logger.WithContext(ctx, log)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pressly/goose/v3"
+	_ "modernc.org/sqlite"
+
+	"github.com/ip812/blog/config"
+	"github.com/ip812/blog/logger"
+)
+
+const (
+	migrationsDir       = "sql/migrations"
+	sqliteMigrationsDir = "sql/sqlite/migrations"
+)
+
+var (
+	//go:embed sql/migrations/*.sql
+	migrationsFS embed.FS
+	//go:embed sql/sqlite/migrations/*.sql
+	sqliteMigrationsFS embed.FS
+)
+
+var migrationNamePattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+func init() {
+	goose.SetBaseFS(migrationsFS)
+	if err := goose.SetDialect("postgres"); err != nil {
+		panic(err)
+	}
+}
+
+// migrateDatabase applies the embedded migrations, or with auto-migrate
+// turned off only checks that none are pending. It reports whether the
+// schema is up to date; the server stays unready if it isn't.
+func migrateDatabase(cfg *config.Config, log logger.Logger, db *sql.DB) bool {
+	if !cfg.Database.AutoMigrate {
+		pending, err := pendingMigrations(db)
+		if err != nil {
+			log.Error("failed to check migrations: %s", err.Error())
+			return false
+		}
+		if pending > 0 {
+			log.Error("%d migrations are pending, run `main migrate up`", pending)
+			return false
+		}
+		return true
+	}
+
+	if err := goose.Up(db, migrationsDir); err != nil {
+		log.Error("failed to run migrations: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+// pendingMigrations returns how many embedded migrations have not been
+// applied to db yet.
+func pendingMigrations(db *sql.DB) (int, error) {
+	current, err := goose.GetDBVersion(db)
+	if err != nil {
+		return 0, err
+	}
+
+	migrations, err := goose.CollectMigrations(migrationsDir, current, goose.MaxVersion)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(migrations), nil
+}
+
+// sqliteMigrations returns a goose provider for the SQLite migrations. They
+// are kept apart from the Postgres ones, which use features SQLite lacks.
+func sqliteMigrations(db *sql.DB) (*goose.Provider, error) {
+	fsys, err := fs.Sub(sqliteMigrationsFS, sqliteMigrationsDir)
+	if err != nil {
+		return nil, err
+	}
+	return goose.NewProvider(goose.DialectSQLite3, db, fsys)
+}
+
+// migrateSQLite is migrateDatabase for the SQLite driver.
+func migrateSQLite(ctx context.Context, cfg *config.Config, log logger.Logger, db *sql.DB) bool {
+	provider, err := sqliteMigrations(db)
+	if err != nil {
+		log.Error("failed to load migrations: %s", err.Error())
+		return false
+	}
+
+	if !cfg.Database.AutoMigrate {
+		pending, err := provider.HasPending(ctx)
+		if err != nil {
+			log.Error("failed to check migrations: %s", err.Error())
+			return false
+		}
+		if pending {
+			log.Error("migrations are pending, run `main migrate up`")
+			return false
+		}
+		return true
+	}
+
+	if _, err := provider.Up(ctx); err != nil {
+		log.Error("failed to run migrations: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+// openSQLite opens the SQLite file at path, creating it if needed. WAL lets
+// readers work while a comment is written, and the busy timeout makes
+// concurrent writers wait for each other instead of failing.
+func openSQLite(ctx context.Context, path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// createMigration adds an empty migration to dir in the source tree,
+// numbered after the last one. It works on the directory on disk, not the
+// embedded copy, so it is meant to be run from the repository root.
+func createMigration(dir, name string) (string, error) {
+	if !migrationNamePattern.MatchString(name) {
+		return "", fmt.Errorf("migration name must be snake_case, got %q", name)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var last int64
+	for _, e := range entries {
+		var version int64
+		if _, err := fmt.Sscanf(e.Name(), "%d_", &version); err == nil {
+			last = max(last, version)
+		}
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%06d_%s.sql", last+1, name))
+	body := strings.Join([]string{"-- +goose Up", "", "-- +goose Down", ""}, "\n")
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
@@ -0,0 +1,383 @@
+package newsletter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ip812/blog/articles"
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtx"
+	"github.com/ip812/blog/idgen"
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/mailer"
+	"github.com/ip812/blog/outbox"
+	"github.com/ip812/blog/secure"
+)
+
+const (
+	EventConfirmationRequested = "newsletter.confirmation_requested"
+	EventArticlePublished      = "newsletter.article_published"
+	EventAnnouncementRequested = "newsletter.announcement_requested"
+)
+
+const (
+	confirmationTTL = 48 * time.Hour
+	// an address gets at most one confirmation mail per cooldown, however
+	// often it is submitted
+	resendCooldown = 15 * time.Minute
+
+	confirmPurpose     = "newsletter-confirm"
+	unsubscribePurpose = "newsletter-unsubscribe"
+)
+
+var ErrInvalidLink = errors.New("the link is invalid or has expired")
+
+type DBProvider interface {
+	DB() (*sql.DB, error)
+}
+
+type confirmationPayload struct {
+	SubscriberID int64 `json:"subscriber_id"`
+	CreatedAt    int64 `json:"created_at"`
+}
+
+type articlePublishedPayload struct {
+	ArticleID int64 `json:"article_id"`
+}
+
+type announcementPayload struct {
+	ArticleID    int64 `json:"article_id"`
+	SubscriberID int64 `json:"subscriber_id"`
+}
+
+type Service struct {
+	db        DBProvider
+	mailer    mailer.Mailer
+	log       logger.Logger
+	baseURL   string
+	secretKey string
+}
+
+func New(db DBProvider, m mailer.Mailer, log logger.Logger, baseURL, secretKey string) *Service {
+	return &Service{
+		db:        db,
+		mailer:    m,
+		log:       log,
+		baseURL:   baseURL,
+		secretKey: secretKey,
+	}
+}
+
+func (s *Service) Register(d *outbox.Dispatcher) {
+	d.Register(EventConfirmationRequested, "newsletter", s.sendConfirmation)
+	d.Register(EventArticlePublished, "newsletter", s.fanOutAnnouncement)
+	d.Register(EventAnnouncementRequested, "newsletter", s.sendAnnouncement)
+}
+
+// Subscribe records the address and queues a confirmation mail. Subscribing
+// an address that is already confirmed is a silent no-op, so the response
+// does not reveal who is on the list. Subscribing an unconfirmed address
+// again within resendCooldown queues no further mail, so the form can't be
+// used to flood someone's inbox.
+func (s *Service) Subscribe(ctx context.Context, email string) error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := database.New(dbtx.Instrument(tx))
+
+	id, err := idgen.NextID()
+	if err != nil {
+		return err
+	}
+
+	sub, err := queries.CreateSubscriber(ctx, database.CreateSubscriberParams{
+		ID:           id,
+		Email:        strings.ToLower(email),
+		ResendBefore: time.Now().Add(-resendCooldown),
+	})
+	if err != nil {
+		return err
+	}
+
+	if sub.ConfirmedAt.Valid {
+		return tx.Commit()
+	}
+
+	err = outbox.Enqueue(
+		ctx,
+		queries,
+		EventConfirmationRequested,
+		fmt.Sprintf("%s:%d:%d", EventConfirmationRequested, sub.ID, sub.CreatedAt.Unix()),
+		confirmationPayload{
+			SubscriberID: sub.ID,
+			CreatedAt:    sub.CreatedAt.Unix(),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Service) Confirm(ctx context.Context, id int64, token string) error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	queries := database.New(dbtx.Instrument(db))
+
+	sub, err := queries.GetSubscriberByID(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidLink
+	}
+	if err != nil {
+		return err
+	}
+
+	if !s.verify(token, confirmPurpose, sub.ID, sub.CreatedAt.Unix()) {
+		return ErrInvalidLink
+	}
+	if sub.ConfirmedAt.Valid {
+		return nil
+	}
+	if time.Since(sub.CreatedAt) > confirmationTTL {
+		return ErrInvalidLink
+	}
+
+	_, err = queries.ConfirmSubscriber(ctx, sub.ID)
+	return err
+}
+
+// Unsubscribe deletes the subscriber outright; nothing about the address is
+// kept once the reader has left.
+func (s *Service) Unsubscribe(ctx context.Context, id int64, token string) error {
+	if !s.verify(token, unsubscribePurpose, id) {
+		return ErrInvalidLink
+	}
+
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	return database.New(dbtx.Instrument(db)).DeleteSubscriber(ctx, id)
+}
+
+// AnnounceNewArticles queues an announcement for every article that has not
+// been announced yet. It is safe to call on every start.
+func (s *Service) AnnounceNewArticles(ctx context.Context) error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range articles.Metadata {
+		if err := s.announce(ctx, db, int64(m.ID)); err != nil {
+			return fmt.Errorf("failed to announce article %d: %w", m.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) announce(ctx context.Context, db *sql.DB, articleID int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := database.New(dbtx.Instrument(tx))
+
+	n, err := queries.CreateNewsletterAnnouncement(ctx, articleID)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+
+	err = outbox.Enqueue(
+		ctx,
+		queries,
+		EventArticlePublished,
+		fmt.Sprintf("%s:%d", EventArticlePublished, articleID),
+		articlePublishedPayload{ArticleID: articleID},
+	)
+	if err != nil {
+		return err
+	}
+
+	s.log.Info("queued newsletter announcement for article %d", articleID)
+	return tx.Commit()
+}
+
+func (s *Service) sendConfirmation(ctx context.Context, e outbox.Event) error {
+	var p confirmationPayload
+	if err := e.Decode(&p); err != nil {
+		return err
+	}
+
+	sub, ok, err := s.subscriber(ctx, p.SubscriberID)
+	if err != nil || !ok {
+		return err
+	}
+	// a later subscribe request superseded this one and queued its own mail
+	if sub.ConfirmedAt.Valid || sub.CreatedAt.Unix() != p.CreatedAt {
+		return nil
+	}
+
+	link := s.link("/p/public/newsletter/confirm", sub.ID, s.sign(confirmPurpose, sub.ID, sub.CreatedAt.Unix()))
+
+	return s.mailer.Send(ctx, mailer.Message{
+		To:      sub.Email,
+		Subject: "Confirm your subscription",
+		Body: fmt.Sprintf(
+			"Hi,\n\nplease confirm that you want to receive new articles from Ilia's blog by opening the link below:\n\n%s\n\nThe link is valid for %d hours. If you did not ask for this, just ignore this mail.\n",
+			link,
+			int(confirmationTTL.Hours()),
+		),
+	})
+}
+
+func (s *Service) fanOutAnnouncement(ctx context.Context, e outbox.Event) error {
+	var p articlePublishedPayload
+	if err := e.Decode(&p); err != nil {
+		return err
+	}
+
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := database.New(dbtx.Instrument(tx))
+
+	ids, err := queries.GetAllConfirmedSubscriberIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	// one event per subscriber, so a failed delivery is retried alone
+	for _, id := range ids {
+		err := outbox.Enqueue(
+			ctx,
+			queries,
+			EventAnnouncementRequested,
+			fmt.Sprintf("%s:%d:%d", EventAnnouncementRequested, p.ArticleID, id),
+			announcementPayload{
+				ArticleID:    p.ArticleID,
+				SubscriberID: id,
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *Service) sendAnnouncement(ctx context.Context, e outbox.Event) error {
+	var p announcementPayload
+	if err := e.Decode(&p); err != nil {
+		return err
+	}
+
+	article := articles.GetByID(uint64(p.ArticleID))
+	if article == nil {
+		s.log.Warn("skipping announcement for unknown article %d", p.ArticleID)
+		return nil
+	}
+
+	// checked at send time so an unsubscribe is honoured even for
+	// announcements that were queued before it
+	sub, ok, err := s.subscriber(ctx, p.SubscriberID)
+	if err != nil || !ok || !sub.ConfirmedAt.Valid {
+		return err
+	}
+
+	unsubscribeURL := s.UnsubscribeURL(sub.ID)
+
+	return s.mailer.Send(ctx, mailer.Message{
+		To:      sub.Email,
+		Subject: fmt.Sprintf("New article: %s", article.Name),
+		Body: fmt.Sprintf(
+			"Hi,\n\na new article is out on Ilia's blog:\n\n%s\n%s\n\n%s\n\n--\nUnsubscribe: %s\n",
+			article.Name,
+			article.Description,
+			s.baseURL+article.URL,
+			unsubscribeURL,
+		),
+		Headers: map[string]string{
+			"List-Unsubscribe":      "<" + unsubscribeURL + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+	})
+}
+
+func (s *Service) UnsubscribeURL(id int64) string {
+	return s.link("/p/public/newsletter/unsubscribe", id, s.sign(unsubscribePurpose, id))
+}
+
+func (s *Service) subscriber(ctx context.Context, id int64) (database.Subscriber, bool, error) {
+	db, err := s.db.DB()
+	if err != nil {
+		return database.Subscriber{}, false, err
+	}
+
+	sub, err := database.New(dbtx.Instrument(db)).GetSubscriberByID(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return sub, false, nil
+	}
+	if err != nil {
+		return sub, false, err
+	}
+
+	return sub, true, nil
+}
+
+func (s *Service) link(path string, id int64, token string) string {
+	q := url.Values{}
+	q.Set("id", strconv.FormatInt(id, 10))
+	q.Set("token", token)
+	return s.baseURL + path + "?" + q.Encode()
+}
+
+func (s *Service) sign(purpose string, values ...int64) string {
+	return secure.Sign(s.secretKey, tokenParts(purpose, values...)...)
+}
+
+func (s *Service) verify(token, purpose string, values ...int64) bool {
+	return secure.Verify(s.secretKey, token, tokenParts(purpose, values...)...)
+}
+
+func tokenParts(purpose string, values ...int64) []string {
+	parts := []string{purpose}
+	for _, v := range values {
+		parts = append(parts, strconv.FormatInt(v, 10))
+	}
+	return parts
+}
@@ -0,0 +1,189 @@
+package newsletter
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ip812/blog/config"
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtest"
+	"github.com/ip812/blog/idgen"
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/mailer"
+	"github.com/ip812/blog/mailer/mailertest"
+	"github.com/ip812/blog/outbox"
+)
+
+const testSecretKey = "a-test-secret-key-of-32-characters"
+
+type staticDB struct {
+	db *sql.DB
+}
+
+func (s staticDB) DB() (*sql.DB, error) {
+	return s.db, nil
+}
+
+func testLogger() logger.Logger {
+	cfg := &config.Config{}
+	cfg.Log.Level = "error"
+	return logger.New(cfg)
+}
+
+func TestTokens(t *testing.T) {
+	s := New(nil, nil, testLogger(), "https://example.com", testSecretKey)
+	token := s.sign(unsubscribePurpose, 42)
+
+	if !s.verify(token, unsubscribePurpose, 42) {
+		t.Error("expected the token to verify")
+	}
+	if s.verify(token, unsubscribePurpose, 43) {
+		t.Error("expected the token of another subscriber to be rejected")
+	}
+	if s.verify(token, confirmPurpose, 42) {
+		t.Error("expected the token to be rejected for another purpose")
+	}
+
+	other := New(nil, nil, testLogger(), "https://example.com", "another-secret-key-of-32-characters")
+	if other.verify(token, unsubscribePurpose, 42) {
+		t.Error("expected the token to be rejected under another key")
+	}
+}
+
+func TestSubscribeConfirmAndCooldown(t *testing.T) {
+	db := dbtest.Open(t)
+	dbtest.Truncate(t, db, "subscribers", "outbox_events")
+
+	allocator, err := idgen.NewFixed(1, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idgen.SetDefault(allocator)
+
+	sink := mailertest.NewSink(t)
+	s := New(staticDB{db}, mailer.NewSMTP(sink.Config()), testLogger(), "https://example.com", testSecretKey)
+	ctx := context.Background()
+
+	for range 3 {
+		if err := s.Subscribe(ctx, "Reader@Example.com"); err != nil {
+			t.Fatalf("failed to subscribe: %s", err)
+		}
+	}
+
+	events := pendingEvents(t, db, EventConfirmationRequested)
+	if len(events) != 1 {
+		t.Fatalf("got %d confirmation events, want 1 within the cooldown", len(events))
+	}
+	if err := s.sendConfirmation(ctx, events[0]); err != nil {
+		t.Fatalf("failed to send the confirmation: %s", err)
+	}
+
+	messages := sink.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("sink got %d messages, want 1", len(messages))
+	}
+	if messages[0].To[0] != "reader@example.com" {
+		t.Errorf("confirmation sent to %v", messages[0].To)
+	}
+
+	id, token := confirmLink(t, messages[0].Body)
+	if err := s.Confirm(ctx, id, token+"x"); err != ErrInvalidLink {
+		t.Errorf("confirming with a forged token = %v, want ErrInvalidLink", err)
+	}
+	if err := s.Confirm(ctx, id, token); err != nil {
+		t.Fatalf("failed to confirm: %s", err)
+	}
+
+	sub, err := database.New(db).GetSubscriberByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sub.ConfirmedAt.Valid {
+		t.Error("expected the subscriber to be confirmed")
+	}
+
+	if err := s.Unsubscribe(ctx, id, s.sign(unsubscribePurpose, id+1)); err != ErrInvalidLink {
+		t.Errorf("unsubscribing with the token of another subscriber = %v, want ErrInvalidLink", err)
+	}
+}
+
+func TestSubscribeAfterCooldown(t *testing.T) {
+	db := dbtest.Open(t)
+	dbtest.Truncate(t, db, "subscribers", "outbox_events")
+
+	allocator, err := idgen.NewFixed(1, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idgen.SetDefault(allocator)
+
+	s := New(staticDB{db}, nil, testLogger(), "https://example.com", testSecretKey)
+	ctx := context.Background()
+
+	if err := s.Subscribe(ctx, "reader@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("UPDATE subscribers SET created_at = $1", time.Now().Add(-resendCooldown-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Subscribe(ctx, "reader@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if events := pendingEvents(t, db, EventConfirmationRequested); len(events) != 2 {
+		t.Fatalf("got %d confirmation events, want 2 after the cooldown", len(events))
+	}
+}
+
+func pendingEvents(t *testing.T, db *sql.DB, eventType string) []outbox.Event {
+	t.Helper()
+
+	rows, err := db.Query(
+		"SELECT id, event_type, idempotency_key, payload FROM outbox_events WHERE event_type = $1 ORDER BY id",
+		eventType,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var events []outbox.Event
+	for rows.Next() {
+		var e outbox.Event
+		if err := rows.Scan(&e.ID, &e.Type, &e.IdempotencyKey, &e.Payload); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func confirmLink(t *testing.T, body string) (int64, string) {
+	t.Helper()
+
+	for _, line := range strings.Split(body, "\n") {
+		if !strings.HasPrefix(line, "https://example.com/p/public/newsletter/confirm") {
+			continue
+		}
+		u, err := url.Parse(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := strconv.ParseInt(u.Query().Get("id"), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id, u.Query().Get("token")
+	}
+	t.Fatalf("no confirmation link in %q", body)
+	return 0, ""
+}
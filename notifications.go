@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ip812/blog/articles"
+	"github.com/ip812/blog/outbox"
+	"github.com/ip812/blog/slack"
+)
+
+func newCommentSlackNotifier(client *slack.Client, channelID string) outbox.Handler {
+	return func(ctx context.Context, e outbox.Event) error {
+		var p outbox.CommentCreatedPayload
+		if err := e.Decode(&p); err != nil {
+			return err
+		}
+
+		article := fmt.Sprintf("article %d", p.ArticleID)
+		if m := articles.GetByID(uint64(p.ArticleID)); m != nil {
+			article = m.Name
+		}
+
+		return client.PostMessage(ctx, channelID, fmt.Sprintf("New comment from %s on \"%s\":\n>%s", p.Username, article, p.Content))
+	}
+}
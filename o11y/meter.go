@@ -0,0 +1,30 @@
+package o11y
+
+import (
+	"context"
+	"fmt"
+
+	prometheusbridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// newMeterProvider exports the OTel metrics (e.g. of otelsql) together with
+// everything registered with the default Prometheus registry, so the
+// collector gets all of them without scraping /metrics.
+func newMeterProvider(ctx context.Context, res *resource.Resource) (*sdkmetric.MeterProvider, error) {
+	exporter, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithInsecure())
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize metric exporter due: %w", err)
+	}
+
+	reader := sdkmetric.NewPeriodicReader(
+		exporter,
+		sdkmetric.WithProducer(prometheusbridge.NewMetricProducer()),
+	)
+	return sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(res),
+	), nil
+}
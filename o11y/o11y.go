@@ -0,0 +1,88 @@
+package o11y
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/log/global"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// ShutdownFunc flushes whatever is still buffered and stops exporting.
+type ShutdownFunc func(ctx context.Context) error
+
+type Options struct {
+	Disabled bool
+	// TraceSampleRatio is the share of traces started here that are
+	// sampled, between 0 and 1.
+	TraceSampleRatio float64
+}
+
+// Setup exports traces, metrics and logs over OTLP and makes the providers
+// the global ones, so all instrumentation libraries use them. The returned
+// ShutdownFunc has to be called on exit, otherwise the last batch of every
+// signal is lost.
+//
+// The tracer and ShutdownFunc are usable in any case: when exporting is
+// disabled or fails to set up, they are no-ops.
+func Setup(ctx context.Context, name string, opts Options) (trace.Tracer, ShutdownFunc, error) {
+	if opts.Disabled {
+		return noopTracer(name), noopShutdown, nil
+	}
+
+	res := resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String(name),
+	)
+
+	var shutdowns []ShutdownFunc
+	shutdown := func(ctx context.Context) error {
+		var errs []error
+		for _, fn := range shutdowns {
+			errs = append(errs, fn(ctx))
+		}
+		return errors.Join(errs...)
+	}
+
+	tp, err := newTracerProvider(ctx, res, opts.TraceSampleRatio)
+	if err != nil {
+		return noopTracer(name), noopShutdown, err
+	}
+	shutdowns = append(shutdowns, tp.Shutdown)
+
+	mp, err := newMeterProvider(ctx, res)
+	if err != nil {
+		shutdown(ctx)
+		return noopTracer(name), noopShutdown, err
+	}
+	shutdowns = append(shutdowns, mp.Shutdown)
+
+	lp, err := newLoggerProvider(ctx, res)
+	if err != nil {
+		shutdown(ctx)
+		return noopTracer(name), noopShutdown, err
+	}
+	shutdowns = append(shutdowns, lp.Shutdown)
+
+	// set the providers and propagator properly, this is to ensure all
+	// instrumentation library could run well
+	otel.SetTracerProvider(tp)
+	otel.SetMeterProvider(mp)
+	global.SetLoggerProvider(lp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return otel.Tracer(name), shutdown, nil
+}
+
+func noopTracer(name string) trace.Tracer {
+	return noop.NewTracerProvider().Tracer(name)
+}
+
+func noopShutdown(context.Context) error {
+	return nil
+}
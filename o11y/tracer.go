@@ -4,40 +4,29 @@ import (
 	"context"
 	"fmt"
 
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
-	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
-	"go.opentelemetry.io/otel/trace"
 )
 
-func NewTracer(name string) (trace.Tracer, error) {
+// newTracerProvider samples ratio of the traces started here, traces coming
+// with a sampled parent (e.g. from the ingress) are always kept, so a trace
+// is never exported half.
+func newTracerProvider(ctx context.Context, res *resource.Resource, ratio float64) (*sdktrace.TracerProvider, error) {
 	// here we don't set any endpoint because by default the otel will load
 	// the endpoint from the environment variable `OTEL_EXPORTER_OTLP_ENDPOINT`
 	exporter, err := otlptrace.New(
-		context.Background(),
+		ctx,
 		otlptracehttp.NewClient(otlptracehttp.WithInsecure()),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("unable to initialize exporter due: %w", err)
+		return nil, fmt.Errorf("unable to initialize trace exporter due: %w", err)
 	}
-	// initialize tracer provider
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
-		sdktrace.WithBatcher(exporter),
-		sdktrace.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceNameKey.String(name),
-		)),
-	)
-	// set tracer provider and propagator properly, this is to ensure all
-	// instrumentation library could run well
-	otel.SetTracerProvider(tp)
-	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 
-	// returns tracer
-	return otel.Tracer(name), nil
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	), nil
 }
@@ -0,0 +1,286 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtx"
+	"github.com/ip812/blog/idgen"
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/metrics"
+	"github.com/ip812/blog/status"
+)
+
+const (
+	EventCommentCreated = "comment.created"
+)
+
+const (
+	defaultPollInterval = 5 * time.Second
+	defaultBatchSize    = 20
+	defaultLease        = 1 * time.Minute
+	defaultBaseBackoff  = 10 * time.Second
+	defaultMaxBackoff   = 1 * time.Hour
+	// with the backoff above an event is given up on after about a day
+	defaultMaxAttempts = 16
+)
+
+type DBProvider interface {
+	DB() (*sql.DB, error)
+}
+
+// Event is a side effect recorded together with the change that caused it.
+// Delivery is at-least-once, so handlers must use IdempotencyKey to drop
+// events they have already processed.
+type Event struct {
+	ID             int64
+	Type           string
+	IdempotencyKey string
+	Payload        json.RawMessage
+	Attempts       int32
+}
+
+func (e Event) Decode(v any) error {
+	return json.Unmarshal(e.Payload, v)
+}
+
+type Handler func(ctx context.Context, e Event) error
+
+type CommentCreatedPayload struct {
+	CommentID int64  `json:"comment_id"`
+	ArticleID int64  `json:"article_id"`
+	Username  string `json:"username"`
+	Content   string `json:"content"`
+}
+
+// Enqueue stores an event using the given queries, which must be bound to the
+// same transaction as the change the event describes. Enqueuing the same
+// idempotency key twice is a no-op.
+func Enqueue(ctx context.Context, queries *database.Queries, eventType, idempotencyKey string, payload any) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s payload: %w", eventType, err)
+	}
+
+	id, err := idgen.NextID()
+	if err != nil {
+		return err
+	}
+
+	return queries.CreateOutboxEvent(ctx, database.CreateOutboxEventParams{
+		ID:             id,
+		EventType:      eventType,
+		IdempotencyKey: idempotencyKey,
+		Payload:        raw,
+	})
+}
+
+type registeredHandler struct {
+	name    string
+	handler Handler
+}
+
+type Dispatcher struct {
+	db  DBProvider
+	log logger.Logger
+
+	mu       sync.RWMutex
+	handlers map[string][]registeredHandler
+
+	pollInterval time.Duration
+	batchSize    int32
+	lease        time.Duration
+	baseBackoff  time.Duration
+	maxBackoff   time.Duration
+	maxAttempts  int32
+}
+
+func NewDispatcher(db DBProvider, log logger.Logger) *Dispatcher {
+	return &Dispatcher{
+		db:           db,
+		log:          log,
+		handlers:     map[string][]registeredHandler{},
+		pollInterval: defaultPollInterval,
+		batchSize:    defaultBatchSize,
+		lease:        defaultLease,
+		baseBackoff:  defaultBaseBackoff,
+		maxBackoff:   defaultMaxBackoff,
+		maxAttempts:  defaultMaxAttempts,
+	}
+}
+
+// Register adds a handler for eventType. Deliveries are tracked by name, so
+// it must be unique per event type.
+func (d *Dispatcher) Register(eventType, name string, h Handler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, registered := range d.handlers[eventType] {
+		if registered.name == name {
+			panic(fmt.Sprintf("outbox handler %s is registered twice for %s", name, eventType))
+		}
+	}
+	d.handlers[eventType] = append(d.handlers[eventType], registeredHandler{
+		name:    name,
+		handler: h,
+	})
+}
+
+// Run polls the outbox until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			n, err := d.dispatchBatch(ctx)
+			if err != nil {
+				if !errors.Is(err, status.ErrDatabaseNotReady) && ctx.Err() == nil {
+					d.log.Error("failed to dispatch outbox events: %s", err.Error())
+				}
+				break
+			}
+			if n < int(d.batchSize) {
+				break
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) dispatchBatch(ctx context.Context) (int, error) {
+	db, err := d.db.DB()
+	if err != nil {
+		return 0, err
+	}
+	queries := database.New(dbtx.Instrument(db))
+
+	// claimed events are hidden from other dispatchers until the lease
+	// expires, so a crash mid-delivery only delays the retry
+	rows, err := queries.ClaimOutboxEvents(ctx, database.ClaimOutboxEventsParams{
+		LeaseUntil: time.Now().UTC().Add(d.lease),
+		BatchSize:  d.batchSize,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, row := range rows {
+		e := Event{
+			ID:             row.ID,
+			Type:           row.EventType,
+			IdempotencyKey: row.IdempotencyKey,
+			Payload:        row.Payload,
+			Attempts:       row.Attempts,
+		}
+
+		if err := d.deliver(ctx, e, queriesLog{queries}); err != nil {
+			lastError := sql.NullString{String: err.Error(), Valid: true}
+			if e.Attempts+1 >= d.maxAttempts {
+				d.log.Error("outbox event %d (%s) failed %d times, giving up: %s", e.ID, e.Type, e.Attempts+1, err.Error())
+				metrics.OutboxEventsFailed.WithLabelValues(e.Type).Inc()
+				err = queries.MarkOutboxEventDead(ctx, database.MarkOutboxEventDeadParams{
+					ID:        e.ID,
+					LastError: lastError,
+				})
+				if err != nil {
+					return len(rows), err
+				}
+				continue
+			}
+
+			d.log.Warn("outbox event %d (%s) failed on attempt %d: %s", e.ID, e.Type, e.Attempts+1, err.Error())
+			err = queries.MarkOutboxEventFailed(ctx, database.MarkOutboxEventFailedParams{
+				ID:            e.ID,
+				LastError:     lastError,
+				NextAttemptAt: time.Now().UTC().Add(d.backoff(e.Attempts)),
+			})
+			if err != nil {
+				return len(rows), err
+			}
+			continue
+		}
+
+		if err := queries.MarkOutboxEventDelivered(ctx, e.ID); err != nil {
+			return len(rows), err
+		}
+	}
+
+	return len(rows), nil
+}
+
+// deliveryLog records which handlers an event was delivered to.
+type deliveryLog interface {
+	Delivered(ctx context.Context, eventID int64) (map[string]bool, error)
+	Record(ctx context.Context, eventID int64, handler string) error
+}
+
+type queriesLog struct {
+	queries *database.Queries
+}
+
+func (l queriesLog) Delivered(ctx context.Context, eventID int64) (map[string]bool, error) {
+	names, err := l.queries.GetOutboxDeliveries(ctx, eventID)
+	if err != nil {
+		return nil, err
+	}
+	delivered := make(map[string]bool, len(names))
+	for _, name := range names {
+		delivered[name] = true
+	}
+	return delivered, nil
+}
+
+func (l queriesLog) Record(ctx context.Context, eventID int64, handler string) error {
+	return l.queries.CreateOutboxDelivery(ctx, database.CreateOutboxDeliveryParams{
+		EventID: eventID,
+		Handler: handler,
+	})
+}
+
+// deliver runs the handlers e wasn't delivered to yet, so a failing handler
+// doesn't make the others run again on the next attempt.
+func (d *Dispatcher) deliver(ctx context.Context, e Event, deliveries deliveryLog) error {
+	d.mu.RLock()
+	handlers := d.handlers[e.Type]
+	d.mu.RUnlock()
+
+	delivered, err := deliveries.Delivered(ctx, e.ID)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, h := range handlers {
+		if delivered[h.name] {
+			continue
+		}
+		if err := h.handler(ctx, e); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", h.name, err))
+			continue
+		}
+		if err := deliveries.Record(ctx, e.ID, h.name); err != nil {
+			errs = append(errs, fmt.Errorf("%s: failed to record the delivery: %w", h.name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (d *Dispatcher) backoff(attempts int32) time.Duration {
+	delay := d.baseBackoff
+	for i := int32(0); i < attempts && delay < d.maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, d.maxBackoff)
+}
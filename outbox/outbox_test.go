@@ -0,0 +1,163 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ip812/blog/config"
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtest"
+	"github.com/ip812/blog/idgen"
+	"github.com/ip812/blog/logger"
+)
+
+type memoryLog map[int64]map[string]bool
+
+func (l memoryLog) Delivered(_ context.Context, eventID int64) (map[string]bool, error) {
+	return l[eventID], nil
+}
+
+func (l memoryLog) Record(_ context.Context, eventID int64, handler string) error {
+	if l[eventID] == nil {
+		l[eventID] = map[string]bool{}
+	}
+	l[eventID][handler] = true
+	return nil
+}
+
+type staticDB struct {
+	db *sql.DB
+}
+
+func (s staticDB) DB() (*sql.DB, error) {
+	return s.db, nil
+}
+
+func testLogger() logger.Logger {
+	cfg := &config.Config{}
+	cfg.Log.Level = "error"
+	return logger.New(cfg)
+}
+
+func newTestDispatcher(db DBProvider) *Dispatcher {
+	return NewDispatcher(db, testLogger())
+}
+
+func TestDeliverRetriesOnlyFailedHandlers(t *testing.T) {
+	d := newTestDispatcher(nil)
+
+	var slackCalls, emailCalls int
+	d.Register(EventCommentCreated, "slack", func(context.Context, Event) error {
+		slackCalls++
+		return nil
+	})
+	d.Register(EventCommentCreated, "email", func(context.Context, Event) error {
+		emailCalls++
+		if emailCalls == 1 {
+			return errors.New("smtp is down")
+		}
+		return nil
+	})
+
+	deliveries := memoryLog{}
+	e := Event{ID: 1, Type: EventCommentCreated}
+
+	if err := d.deliver(context.Background(), e, deliveries); err == nil {
+		t.Fatal("expected the first delivery to fail")
+	}
+	if err := d.deliver(context.Background(), e, deliveries); err != nil {
+		t.Fatalf("expected the retry to succeed, got %s", err)
+	}
+
+	if slackCalls != 1 {
+		t.Errorf("slack handler ran %d times, want 1", slackCalls)
+	}
+	if emailCalls != 2 {
+		t.Errorf("email handler ran %d times, want 2", emailCalls)
+	}
+}
+
+func TestRegisterRejectsDuplicateNames(t *testing.T) {
+	d := newTestDispatcher(nil)
+	d.Register(EventCommentCreated, "slack", func(context.Context, Event) error { return nil })
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering the same name twice to panic")
+		}
+	}()
+	d.Register(EventCommentCreated, "slack", func(context.Context, Event) error { return nil })
+}
+
+func TestBackoff(t *testing.T) {
+	d := newTestDispatcher(nil)
+
+	tests := []struct {
+		attempts int32
+		want     time.Duration
+	}{
+		{attempts: 0, want: 10 * time.Second},
+		{attempts: 1, want: 20 * time.Second},
+		{attempts: 3, want: 80 * time.Second},
+		{attempts: 20, want: time.Hour},
+	}
+	for _, tt := range tests {
+		if got := d.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestDispatcherGivesUpAfterMaxAttempts(t *testing.T) {
+	db := dbtest.Open(t)
+	dbtest.Truncate(t, db, "outbox_events")
+
+	allocator, err := idgen.NewFixed(1, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idgen.SetDefault(allocator)
+
+	ctx := context.Background()
+	err = Enqueue(ctx, database.New(db), EventCommentCreated, "comment:1", CommentCreatedPayload{CommentID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTestDispatcher(staticDB{db})
+	d.lease = 0
+	d.baseBackoff = 0
+	d.maxAttempts = 2
+
+	var slackCalls int
+	d.Register(EventCommentCreated, "slack", func(context.Context, Event) error {
+		slackCalls++
+		return nil
+	})
+	d.Register(EventCommentCreated, "email", func(context.Context, Event) error {
+		return errors.New("smtp is down")
+	})
+
+	for range 3 {
+		if _, err := d.dispatchBatch(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if slackCalls != 1 {
+		t.Errorf("slack handler ran %d times, want 1", slackCalls)
+	}
+
+	var attempts int32
+	var failed sql.NullTime
+	err = db.QueryRow("SELECT attempts, failed_at FROM outbox_events WHERE idempotency_key = 'comment:1'").Scan(&attempts, &failed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 || !failed.Valid {
+		t.Errorf("got %d attempts and failed_at %v, want 2 attempts and the event failed", attempts, failed)
+	}
+}
@@ -0,0 +1,122 @@
+package privacy
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtx"
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/store"
+)
+
+type DBProvider interface {
+	DB() (*sql.DB, error)
+}
+
+// Retention is how long records are kept, zero keeps them forever.
+type Retention struct {
+	PageViews    time.Duration
+	OutboxEvents time.Duration
+}
+
+// Erased is what was removed for a user.
+type Erased struct {
+	Comments      int64
+	Subscriptions int64
+	Events        int64
+}
+
+// Service removes personal data: everything tied to a commenter on request,
+// and old analytics and delivered events once they are past retention.
+type Service struct {
+	comments  store.CommentStore
+	db        DBProvider
+	log       logger.Logger
+	retention Retention
+}
+
+// New takes the database holding everything but comments, nil when there is
+// none (e.g. on SQLite), in which case only comments are erased.
+func New(comments store.CommentStore, db DBProvider, log logger.Logger, retention Retention) *Service {
+	return &Service{
+		comments:  comments,
+		db:        db,
+		log:       log,
+		retention: retention,
+	}
+}
+
+// Erase deletes the comments of username together with their reply
+// subscriptions and the events still carrying their content. Running it
+// again for the same user is a no-op.
+func (s *Service) Erase(ctx context.Context, username string) (Erased, error) {
+	var erased Erased
+
+	n, err := s.comments.DeleteByUsername(ctx, username)
+	if err != nil {
+		return erased, err
+	}
+	erased.Comments = n
+
+	if s.db == nil {
+		return erased, nil
+	}
+
+	db, err := s.db.DB()
+	if err != nil {
+		return erased, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return erased, err
+	}
+	defer tx.Rollback()
+
+	queries := database.New(dbtx.Instrument(tx))
+	if erased.Subscriptions, err = queries.DeleteCommentSubscriptionsByUsername(ctx, username); err != nil {
+		return erased, err
+	}
+	if erased.Events, err = queries.DeleteOutboxEventsByUsername(ctx, username); err != nil {
+		return erased, err
+	}
+
+	return erased, tx.Commit()
+}
+
+// Purge deletes the records past retention.
+func (s *Service) Purge(ctx context.Context) error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	queries := database.New(dbtx.Instrument(db))
+	now := time.Now().UTC()
+
+	if s.retention.PageViews > 0 {
+		n, err := queries.DeletePageViewsBefore(ctx, now.Add(-s.retention.PageViews))
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			s.log.Info("purged %d page views", n)
+		}
+	}
+
+	if s.retention.OutboxEvents > 0 {
+		n, err := queries.DeleteFinishedOutboxEventsBefore(ctx, sql.NullTime{
+			Time:  now.Add(-s.retention.OutboxEvents),
+			Valid: true,
+		})
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			s.log.Info("purged %d delivered or failed outbox events", n)
+		}
+	}
+
+	return nil
+}
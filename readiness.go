@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/ip812/blog/idgen"
+)
+
+const readinessPingTimeout = 2 * time.Second
+
+var errMigrationsPending = errors.New("migrations have not completed")
+
+// states of telemetry reported by Readiness.Telemetry
+const (
+	TelemetryPending  = "pending"
+	TelemetryOK       = "ok"
+	TelemetryDisabled = "disabled"
+	TelemetryNoop     = "no-op"
+)
+
+// Readiness tracks whether the app can serve requests that need its
+// dependencies. The process is live as soon as it runs, but it is ready only
+// once the database is reachable, migrations have completed and IDs can be
+// minted. Telemetry is reported too, but it is not a dependency: without it
+// a no-op tracer is used and requests are served all the same.
+type Readiness struct {
+	db        DBWrapper
+	migrated  atomic.Bool
+	telemetry atomic.Value
+}
+
+func NewReadiness(db DBWrapper) *Readiness {
+	rd := &Readiness{db: db}
+	rd.telemetry.Store(TelemetryPending)
+	return rd
+}
+
+// SetTelemetry records how o11y.Setup went, e.g. TelemetryNoop when it
+// failed and the no-op fallback is used.
+func (rd *Readiness) SetTelemetry(state string) {
+	rd.telemetry.Store(state)
+}
+
+func (rd *Readiness) Telemetry() string {
+	return rd.telemetry.Load().(string)
+}
+
+func (rd *Readiness) SetMigrated() {
+	rd.migrated.Store(true)
+}
+
+func (rd *Readiness) Migrated() bool {
+	return rd.migrated.Load()
+}
+
+// Check runs every readiness check and returns the result of each of them,
+// nil meaning the check passed.
+func (rd *Readiness) Check(ctx context.Context) map[string]error {
+	checks := map[string]error{
+		"database":   rd.pingDB(ctx),
+		"migrations": nil,
+		"machine_id": nil,
+	}
+	if !rd.migrated.Load() {
+		checks["migrations"] = errMigrationsPending
+	}
+	if err := idgen.Check(); err != nil {
+		checks["machine_id"] = err
+	}
+	return checks
+}
+
+func (rd *Readiness) pingDB(ctx context.Context) error {
+	db, err := rd.db.DB()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readinessPingTimeout)
+	defer cancel()
+
+	return db.PingContext(ctx)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ip812/blog/config"
+	"github.com/ip812/blog/idgen"
+	"github.com/ip812/blog/logger"
+)
+
+type staticDB struct {
+	db *sql.DB
+}
+
+func (s staticDB) DB() (*sql.DB, error) {
+	return s.db, nil
+}
+
+func (s staticDB) ReadDB(ctx context.Context) (*sql.DB, error) {
+	return s.db, nil
+}
+
+func TestReadyzReportsTelemetryWithoutGatingOnIt(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cfg := &config.Config{}
+	cfg.Log.Level = "error"
+	allocator, err := idgen.NewFixed(1, logger.New(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idgen.SetDefault(allocator)
+
+	readiness := NewReadiness(staticDB{db})
+	readiness.SetMigrated()
+	hnd := &Handler{readiness: readiness}
+
+	for _, state := range []string{TelemetryPending, TelemetryNoop, TelemetryOK} {
+		readiness.SetTelemetry(state)
+
+		w := httptest.NewRecorder()
+		hnd.Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		var res struct {
+			Ready     bool              `json:"ready"`
+			Checks    map[string]string `json:"checks"`
+			Telemetry string            `json:"telemetry"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK || !res.Ready {
+			t.Errorf("telemetry %s: status %d, ready %t, checks %v, want ready", state, w.Code, res.Ready, res.Checks)
+		}
+		if res.Telemetry != state {
+			t.Errorf("telemetry = %q, want %q", res.Telemetry, state)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package replies
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ip812/blog/articles"
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtx"
+	"github.com/ip812/blog/idgen"
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/mailer"
+	"github.com/ip812/blog/outbox"
+	"github.com/ip812/blog/secure"
+)
+
+const (
+	EventConfirmationRequested = "replies.confirmation_requested"
+	EventNotificationRequested = "replies.notification_requested"
+)
+
+const (
+	confirmationTTL = 48 * time.Hour
+	// an address gets at most one confirmation mail per article and
+	// cooldown, however often it is submitted
+	resendCooldown = 15 * time.Minute
+
+	confirmPurpose     = "replies-confirm"
+	unsubscribePurpose = "replies-unsubscribe"
+	excerptLength      = 280
+)
+
+var (
+	ErrInvalidLink = errors.New("the link is invalid or has expired")
+	// ErrDisabled is returned for subscriptions while no encryption key is
+	// configured, as the address could not be stored.
+	ErrDisabled = errors.New("reply notifications are disabled")
+)
+
+type DBProvider interface {
+	DB() (*sql.DB, error)
+}
+
+type confirmationPayload struct {
+	SubscriptionID int64 `json:"subscription_id"`
+	CreatedAt      int64 `json:"created_at"`
+}
+
+type notificationPayload struct {
+	SubscriptionID int64 `json:"subscription_id"`
+	CommentID      int64 `json:"comment_id"`
+}
+
+// Service lets commenters opt in to an email whenever someone else comments
+// on the same article. Addresses are stored encrypted for sending and as a
+// keyed hash, so the same address is only subscribed once per article. Like
+// the newsletter, nothing but the confirmation mail is sent to an address
+// before its owner confirmed it.
+type Service struct {
+	db        DBProvider
+	mailer    mailer.Mailer
+	cipher    *secure.Cipher
+	log       logger.Logger
+	baseURL   string
+	secretKey string
+}
+
+func New(db DBProvider, m mailer.Mailer, cipher *secure.Cipher, log logger.Logger, baseURL, secretKey string) *Service {
+	return &Service{
+		db:        db,
+		mailer:    m,
+		cipher:    cipher,
+		log:       log,
+		baseURL:   baseURL,
+		secretKey: secretKey,
+	}
+}
+
+// Enabled reports whether commenters can opt in to notifications.
+func (s *Service) Enabled() bool {
+	return s.cipher != nil
+}
+
+func (s *Service) Register(d *outbox.Dispatcher) {
+	d.Register(EventConfirmationRequested, "replies", s.sendConfirmation)
+	d.Register(outbox.EventCommentCreated, "replies", s.fanOutNotifications)
+	d.Register(EventNotificationRequested, "replies", s.sendNotification)
+}
+
+// Subscribe records a pending subscription and queues its confirmation
+// mail. It must be called with queries bound to the transaction that creates
+// the comment. An address already subscribed to the article keeps its
+// subscription, whoever submits it again, and gets at most one confirmation
+// mail per resendCooldown.
+func (s *Service) Subscribe(ctx context.Context, queries *database.Queries, articleID int64, username, email string) error {
+	if !s.Enabled() {
+		return ErrDisabled
+	}
+
+	email = strings.ToLower(email)
+
+	id, err := idgen.NextID()
+	if err != nil {
+		return err
+	}
+
+	sub, err := queries.CreateCommentSubscription(ctx, database.CreateCommentSubscriptionParams{
+		ID:             id,
+		ArticleID:      articleID,
+		Username:       username,
+		EmailHash:      secure.Hash(s.secretKey, email),
+		EmailEncrypted: s.cipher.Encrypt([]byte(email)),
+		ResendBefore:   time.Now().Add(-resendCooldown),
+	})
+	if err != nil {
+		return err
+	}
+	if sub.ConfirmedAt.Valid {
+		return nil
+	}
+
+	return outbox.Enqueue(
+		ctx,
+		queries,
+		EventConfirmationRequested,
+		fmt.Sprintf("%s:%d:%d", EventConfirmationRequested, sub.ID, sub.CreatedAt.Unix()),
+		confirmationPayload{
+			SubscriptionID: sub.ID,
+			CreatedAt:      sub.CreatedAt.Unix(),
+		},
+	)
+}
+
+func (s *Service) Confirm(ctx context.Context, id int64, token string) error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	queries := database.New(dbtx.Instrument(db))
+
+	sub, err := queries.GetCommentSubscriptionByID(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidLink
+	}
+	if err != nil {
+		return err
+	}
+
+	if !secure.Verify(s.secretKey, token, confirmPurpose, strconv.FormatInt(sub.ID, 10), strconv.FormatInt(sub.CreatedAt.Unix(), 10)) {
+		return ErrInvalidLink
+	}
+	if sub.ConfirmedAt.Valid {
+		return nil
+	}
+	if time.Since(sub.CreatedAt) > confirmationTTL {
+		return ErrInvalidLink
+	}
+
+	_, err = queries.ConfirmCommentSubscription(ctx, sub.ID)
+	return err
+}
+
+func (s *Service) Unsubscribe(ctx context.Context, id int64, token string) error {
+	if !secure.Verify(s.secretKey, token, unsubscribePurpose, strconv.FormatInt(id, 10)) {
+		return ErrInvalidLink
+	}
+
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	return database.New(dbtx.Instrument(db)).DeleteCommentSubscription(ctx, id)
+}
+
+func (s *Service) ConfirmURL(id int64, createdAt time.Time) string {
+	q := url.Values{}
+	q.Set("id", strconv.FormatInt(id, 10))
+	q.Set("token", secure.Sign(s.secretKey, confirmPurpose, strconv.FormatInt(id, 10), strconv.FormatInt(createdAt.Unix(), 10)))
+	return s.baseURL + "/p/public/comments/confirm?" + q.Encode()
+}
+
+func (s *Service) UnsubscribeURL(id int64) string {
+	q := url.Values{}
+	q.Set("id", strconv.FormatInt(id, 10))
+	q.Set("token", secure.Sign(s.secretKey, unsubscribePurpose, strconv.FormatInt(id, 10)))
+	return s.baseURL + "/p/public/comments/unsubscribe?" + q.Encode()
+}
+
+func (s *Service) sendConfirmation(ctx context.Context, e outbox.Event) error {
+	var p confirmationPayload
+	if err := e.Decode(&p); err != nil {
+		return err
+	}
+
+	// the address can't be decrypted without the key, retrying won't help
+	if !s.Enabled() {
+		s.log.Warn("reply notifications are disabled, dropping confirmation for subscription %d", p.SubscriptionID)
+		return nil
+	}
+
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	sub, err := database.New(dbtx.Instrument(db)).GetCommentSubscriptionByID(ctx, p.SubscriptionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// a later subscribe request superseded this one and queued its own mail
+	if sub.ConfirmedAt.Valid || sub.CreatedAt.Unix() != p.CreatedAt {
+		return nil
+	}
+
+	email, err := s.cipher.Decrypt(sub.EmailEncrypted)
+	if err != nil {
+		return err
+	}
+
+	title := fmt.Sprintf("article %d", sub.ArticleID)
+	if m := articles.GetByID(uint64(sub.ArticleID)); m != nil {
+		title = m.Name
+	}
+
+	return s.mailer.Send(ctx, mailer.Message{
+		To:      string(email),
+		Subject: fmt.Sprintf("Confirm notifications for \"%s\"", title),
+		Body: fmt.Sprintf(
+			"Hi,\n\nplease confirm that you want an email whenever someone comments on \"%s\" by opening the link below:\n\n%s\n\nThe link is valid for %d hours. If you did not ask for this, just ignore this mail.\n",
+			title,
+			s.ConfirmURL(sub.ID, sub.CreatedAt),
+			int(confirmationTTL.Hours()),
+		),
+	})
+}
+
+func (s *Service) fanOutNotifications(ctx context.Context, e outbox.Event) error {
+	var p outbox.CommentCreatedPayload
+	if err := e.Decode(&p); err != nil {
+		return err
+	}
+
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := database.New(dbtx.Instrument(tx))
+
+	// commenters are never notified about their own comments
+	ids, err := queries.GetCommentSubscriptionIDsToNotify(ctx, database.GetCommentSubscriptionIDsToNotifyParams{
+		ArticleID: p.ArticleID,
+		Username:  p.Username,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		err := outbox.Enqueue(
+			ctx,
+			queries,
+			EventNotificationRequested,
+			fmt.Sprintf("%s:%d:%d", EventNotificationRequested, p.CommentID, id),
+			notificationPayload{
+				SubscriptionID: id,
+				CommentID:      p.CommentID,
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *Service) sendNotification(ctx context.Context, e outbox.Event) error {
+	var p notificationPayload
+	if err := e.Decode(&p); err != nil {
+		return err
+	}
+
+	// the address can't be decrypted without the key, retrying won't help
+	if !s.Enabled() {
+		s.log.Warn("reply notifications are disabled, dropping notification for subscription %d", p.SubscriptionID)
+		return nil
+	}
+
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	queries := database.New(dbtx.Instrument(db))
+
+	// checked at send time too, the fan out only picks confirmed ones
+	sub, err := queries.GetCommentSubscriptionByID(ctx, p.SubscriptionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !sub.ConfirmedAt.Valid {
+		return nil
+	}
+
+	comment, err := queries.GetCommentByID(ctx, p.CommentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	email, err := s.cipher.Decrypt(sub.EmailEncrypted)
+	if err != nil {
+		return err
+	}
+
+	title := fmt.Sprintf("article %d", sub.ArticleID)
+	link := s.baseURL
+	if m := articles.GetByID(uint64(sub.ArticleID)); m != nil {
+		title = m.Name
+		link += m.URL
+	}
+
+	unsubscribeURL := s.UnsubscribeURL(sub.ID)
+
+	return s.mailer.Send(ctx, mailer.Message{
+		To:      string(email),
+		Subject: fmt.Sprintf("New comment on \"%s\"", title),
+		Body: fmt.Sprintf(
+			"Hi,\n\n%s commented on \"%s\":\n\n%s\n\nRead the discussion: %s\n\n--\nStop notifications for this article: %s\n",
+			comment.Username,
+			title,
+			excerpt(comment.Content),
+			link,
+			unsubscribeURL,
+		),
+		Headers: map[string]string{
+			"List-Unsubscribe":      "<" + unsubscribeURL + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+	})
+}
+
+func excerpt(content string) string {
+	r := []rune(content)
+	if len(r) <= excerptLength {
+		return content
+	}
+	return string(r[:excerptLength]) + "..."
+}
@@ -0,0 +1,270 @@
+package replies
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ip812/blog/config"
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtest"
+	"github.com/ip812/blog/idgen"
+	"github.com/ip812/blog/logger"
+	"github.com/ip812/blog/mailer"
+	"github.com/ip812/blog/mailer/mailertest"
+	"github.com/ip812/blog/outbox"
+	"github.com/ip812/blog/secure"
+)
+
+const testSecretKey = "a-test-secret-key-of-32-characters"
+
+type staticDB struct {
+	db *sql.DB
+}
+
+func (s staticDB) DB() (*sql.DB, error) {
+	return s.db, nil
+}
+
+func testLogger() logger.Logger {
+	cfg := &config.Config{}
+	cfg.Log.Level = "error"
+	return logger.New(cfg)
+}
+
+func TestDisabledWithoutCipher(t *testing.T) {
+	s := New(nil, nil, nil, testLogger(), "https://example.com", testSecretKey)
+
+	if s.Enabled() {
+		t.Fatal("expected notifications to be disabled without a cipher")
+	}
+
+	err := s.Subscribe(context.Background(), nil, 1, "user_1", "reader@example.com")
+	if !errors.Is(err, ErrDisabled) {
+		t.Errorf("Subscribe = %v, want ErrDisabled", err)
+	}
+
+	e := outbox.Event{Type: EventNotificationRequested, Payload: []byte(`{"subscription_id":1,"comment_id":2}`)}
+	if err := s.sendNotification(context.Background(), e); err != nil {
+		t.Errorf("sendNotification = %v, want the event to be dropped", err)
+	}
+}
+
+func testService(t *testing.T, db *sql.DB, m mailer.Mailer) *Service {
+	t.Helper()
+
+	allocator, err := idgen.NewFixed(1, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idgen.SetDefault(allocator)
+
+	cipher, err := secure.NewCipher(base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(staticDB{db}, m, cipher, testLogger(), "https://example.com", testSecretKey)
+}
+
+// commentBy fans out a comment on article 1 and returns the subscriptions
+// it was queued for.
+func commentBy(t *testing.T, s *Service, db *sql.DB, commentID int64, username string) []int64 {
+	t.Helper()
+
+	payload, err := json.Marshal(outbox.CommentCreatedPayload{
+		CommentID: commentID,
+		ArticleID: 1,
+		Username:  username,
+		Content:   "a reply",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.fanOutNotifications(context.Background(), outbox.Event{Type: outbox.EventCommentCreated, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int64
+	for _, e := range pendingEvents(t, db, EventNotificationRequested) {
+		var p notificationPayload
+		if err := e.Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		if p.CommentID == commentID {
+			ids = append(ids, p.SubscriptionID)
+		}
+	}
+	return ids
+}
+
+func TestSubscriptionsArePendingUntilConfirmed(t *testing.T) {
+	db := dbtest.Open(t)
+	dbtest.Truncate(t, db, "comment_subscriptions", "outbox_events")
+
+	sink := mailertest.NewSink(t)
+	s := testService(t, db, mailer.NewSMTP(sink.Config()))
+	ctx := context.Background()
+
+	if err := s.Subscribe(ctx, database.New(db), 1, "user_1", "Reader@Example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := commentBy(t, s, db, 100, "user_2"); len(ids) != 0 {
+		t.Errorf("unconfirmed subscription was notified: %v", ids)
+	}
+
+	events := pendingEvents(t, db, EventConfirmationRequested)
+	if len(events) != 1 {
+		t.Fatalf("got %d confirmation events, want 1", len(events))
+	}
+	if err := s.sendConfirmation(ctx, events[0]); err != nil {
+		t.Fatalf("failed to send the confirmation: %s", err)
+	}
+	messages := sink.Messages()
+	if len(messages) != 1 || messages[0].To[0] != "reader@example.com" {
+		t.Fatalf("sink got %+v, want one confirmation to reader@example.com", messages)
+	}
+
+	id, token := confirmLink(t, messages[0].Body)
+	if err := s.Confirm(ctx, id, token+"x"); !errors.Is(err, ErrInvalidLink) {
+		t.Errorf("confirming with a forged token = %v, want ErrInvalidLink", err)
+	}
+	if err := s.Confirm(ctx, id, token); err != nil {
+		t.Fatalf("failed to confirm: %s", err)
+	}
+
+	if ids := commentBy(t, s, db, 101, "user_2"); len(ids) != 1 || ids[0] != id {
+		t.Errorf("confirmed subscription notified as %v, want [%d]", ids, id)
+	}
+}
+
+func TestSubscriptionsCantBeTakenOver(t *testing.T) {
+	db := dbtest.Open(t)
+	dbtest.Truncate(t, db, "comment_subscriptions", "outbox_events")
+
+	s := testService(t, db, nil)
+	ctx := context.Background()
+
+	if err := s.Subscribe(ctx, database.New(db), 1, "user_1", "reader@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := database.New(db).GetCommentSubscriptionByID(ctx, pendingConfirmation(t, db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.New(db).ConfirmCommentSubscription(ctx, sub.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// another commenter submitting the same address neither rebinds the
+	// subscription nor gets anything sent to it
+	if err := s.Subscribe(ctx, database.New(db), 1, "user_2", "reader@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := database.New(db).GetCommentSubscriptionByID(ctx, sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Username != "user_1" || !after.CreatedAt.Equal(sub.CreatedAt) {
+		t.Errorf("subscription became %+v, want it kept for user_1", after)
+	}
+	if events := pendingEvents(t, db, EventConfirmationRequested); len(events) != 1 {
+		t.Errorf("got %d confirmation events, want only the first one", len(events))
+	}
+
+	if ids := commentBy(t, s, db, 100, "user_1"); len(ids) != 0 {
+		t.Errorf("user_1 was notified about their own comment: %v", ids)
+	}
+	if ids := commentBy(t, s, db, 101, "user_2"); len(ids) != 1 {
+		t.Errorf("got notifications %v for a comment of user_2, want the one of user_1", ids)
+	}
+}
+
+func pendingConfirmation(t *testing.T, db *sql.DB) int64 {
+	t.Helper()
+
+	events := pendingEvents(t, db, EventConfirmationRequested)
+	if len(events) != 1 {
+		t.Fatalf("got %d confirmation events, want 1", len(events))
+	}
+	var p confirmationPayload
+	if err := events[0].Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	return p.SubscriptionID
+}
+
+func pendingEvents(t *testing.T, db *sql.DB, eventType string) []outbox.Event {
+	t.Helper()
+
+	rows, err := db.Query(
+		"SELECT id, event_type, idempotency_key, payload FROM outbox_events WHERE event_type = $1 ORDER BY id",
+		eventType,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var events []outbox.Event
+	for rows.Next() {
+		var e outbox.Event
+		if err := rows.Scan(&e.ID, &e.Type, &e.IdempotencyKey, &e.Payload); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func confirmLink(t *testing.T, body string) (int64, string) {
+	t.Helper()
+
+	for _, line := range strings.Split(body, "\n") {
+		if !strings.HasPrefix(line, "https://example.com/p/public/comments/confirm") {
+			continue
+		}
+		u, err := url.Parse(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := strconv.ParseInt(u.Query().Get("id"), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id, u.Query().Get("token")
+	}
+	t.Fatalf("no confirmation link in %q", body)
+	return 0, ""
+}
+
+func TestConfirmURL(t *testing.T) {
+	s := New(nil, nil, nil, testLogger(), "https://example.com", testSecretKey)
+	createdAt := time.Unix(1700000000, 0)
+
+	u, err := url.Parse(s.ConfirmURL(42, createdAt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := u.Query().Get("token")
+
+	if !secure.Verify(testSecretKey, token, confirmPurpose, "42", "1700000000") {
+		t.Error("expected the token to verify")
+	}
+	// a confirmation requested again gets a new link, the old one expires
+	if secure.Verify(testSecretKey, token, confirmPurpose, "42", "1700000001") {
+		t.Error("expected the token of an earlier request to be rejected")
+	}
+	if secure.Verify(testSecretKey, token, unsubscribePurpose, "42") {
+		t.Error("expected the token to be rejected for another purpose")
+	}
+}
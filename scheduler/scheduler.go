@@ -0,0 +1,316 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/robfig/cron/v3"
+
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtx"
+	"github.com/ip812/blog/logger"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+const (
+	tickInterval = 10 * time.Second
+	// every replica runs the same scheduler, the one holding this session
+	// level advisory lock is the leader and the only one running jobs
+	leaderLockKey int64 = 0x626c6f675f6a6f62 // "blog_job"
+)
+
+var parser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+var (
+	opsLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "blog_scheduler_leader",
+		Help: "Whether this replica runs the scheduled jobs",
+	})
+	opsJobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_scheduler_job_runs_total",
+		Help: "Total number of scheduled job runs by outcome",
+	}, []string{"job", "outcome"})
+	opsJobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "blog_scheduler_job_duration_seconds",
+		Help:    "Duration of scheduled job runs",
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 8),
+	}, []string{"job"})
+	opsJobLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "blog_scheduler_job_last_success_timestamp_seconds",
+		Help: "Time of the last successful run of a scheduled job",
+	}, []string{"job"})
+	opsJobNextRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "blog_scheduler_job_next_run_timestamp_seconds",
+		Help: "Time of the next run of a scheduled job",
+	}, []string{"job"})
+)
+
+type DBProvider interface {
+	DB() (*sql.DB, error)
+}
+
+type JobFunc func(ctx context.Context) error
+
+type job struct {
+	name     string
+	spec     string
+	schedule cron.Schedule
+	run      JobFunc
+	running  atomic.Bool
+}
+
+// Scheduler runs named jobs on cron schedules (e.g. "0 */6 * * *" or
+// "@daily") once across all replicas. The state of every job is kept in the
+// scheduled_jobs table, so a new leader picks up where the previous one
+// stopped.
+type Scheduler struct {
+	db   DBProvider
+	log  logger.Logger
+	name string
+
+	jobs []*job
+
+	// leader is the connection holding the advisory lock, pool is the one
+	// it was taken from. Jobs run with term, which ends with the leadership.
+	leader  *sql.Conn
+	pool    *sql.DB
+	term    context.Context
+	endTerm context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func New(db DBProvider, log logger.Logger) *Scheduler {
+	hostname, _ := os.Hostname()
+	return &Scheduler{
+		db:   db,
+		log:  log,
+		name: fmt.Sprintf("%s/%d", hostname, os.Getpid()),
+	}
+}
+
+// Register adds a job, it must be called before Run.
+func (s *Scheduler) Register(name, spec string, run JobFunc) error {
+	schedule, err := parser.Parse(spec)
+	if err != nil {
+		return fmt.Errorf("invalid schedule %q of job %s: %w", spec, name, err)
+	}
+
+	s.jobs = append(s.jobs, &job{
+		name:     name,
+		spec:     spec,
+		schedule: schedule,
+		run:      run,
+	})
+	return nil
+}
+
+// Run competes for leadership and, while leader, runs due jobs until ctx is
+// cancelled. Running jobs are cancelled with it and waited for.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	defer s.resign()
+
+	for {
+		if s.elect(ctx) {
+			s.runDueJobs()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// elect reports whether this replica is the leader, taking the lock when
+// nobody holds it. Leadership is given up when the connection holding the
+// lock breaks or the pool was replaced.
+func (s *Scheduler) elect(ctx context.Context) bool {
+	db, err := s.db.DB()
+	if err != nil {
+		s.resign()
+		return false
+	}
+
+	if s.leader != nil {
+		if s.pool == db && s.leader.PingContext(ctx) == nil {
+			return true
+		}
+		s.log.Warn("lost the scheduler leadership")
+		s.resign()
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", leaderLockKey).Scan(&locked); err != nil || !locked {
+		conn.Close()
+		return false
+	}
+
+	s.leader = conn
+	s.pool = db
+	s.term, s.endTerm = context.WithCancel(ctx)
+	opsLeader.Set(1)
+	s.log.Info("%s is the scheduler leader", s.name)
+
+	if err := s.syncJobs(ctx, db); err != nil {
+		s.log.Error("failed to register scheduled jobs: %s", err.Error())
+		s.resign()
+		return false
+	}
+
+	return true
+}
+
+// resign cancels the running jobs, they are of no use once another replica
+// may start them too, and gives up the lock.
+func (s *Scheduler) resign() {
+	if s.leader == nil {
+		return
+	}
+
+	s.endTerm()
+	s.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.leader.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", leaderLockKey)
+	// the connection is dropped instead of going back to the pool, ending
+	// the session and with it the lock, even if unlocking failed
+	s.leader.Raw(func(any) error { return driver.ErrBadConn })
+	s.leader.Close()
+
+	s.leader = nil
+	s.pool = nil
+	s.term, s.endTerm = nil, nil
+	opsLeader.Set(0)
+}
+
+func (s *Scheduler) syncJobs(ctx context.Context, db *sql.DB) error {
+	queries := database.New(dbtx.Instrument(db))
+	now := time.Now()
+	for _, j := range s.jobs {
+		err := queries.UpsertScheduledJob(ctx, database.UpsertScheduledJobParams{
+			Name:      j.name,
+			Schedule:  j.spec,
+			NextRunAt: j.schedule.Next(now),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) runDueJobs() {
+	ctx := s.term
+	rows, err := database.New(dbtx.Instrument(s.pool)).GetScheduledJobs(ctx)
+	if err != nil {
+		s.log.Warn("failed to load scheduled jobs: %s", err.Error())
+		return
+	}
+
+	now := time.Now()
+	for _, row := range rows {
+		opsJobNextRun.WithLabelValues(row.Name).Set(float64(row.NextRunAt.Unix()))
+
+		j := s.job(row.Name)
+		if j == nil || row.NextRunAt.After(now) || j.running.Load() {
+			continue
+		}
+
+		// the next run is recorded before this one starts, so a job is
+		// never run twice for the same slot after a failover
+		next := j.schedule.Next(now)
+		err := database.New(dbtx.Instrument(s.pool)).StartScheduledJob(ctx, database.StartScheduledJobParams{
+			Name:      j.name,
+			NextRunAt: next,
+			Runner:    sql.NullString{String: s.name, Valid: true},
+		})
+		if err != nil {
+			s.log.Warn("failed to start job %s: %s", j.name, err.Error())
+			continue
+		}
+		opsJobNextRun.WithLabelValues(j.name).Set(float64(next.Unix()))
+
+		j.running.Store(true)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer j.running.Store(false)
+			s.runJob(ctx, j)
+		}()
+	}
+}
+
+func (s *Scheduler) runJob(ctx context.Context, j *job) {
+	started := time.Now()
+	err := j.run(ctx)
+	duration := time.Since(started)
+
+	outcome := OutcomeSuccess
+	var lastError sql.NullString
+	if err != nil {
+		outcome = OutcomeFailure
+		lastError = sql.NullString{String: err.Error(), Valid: true}
+		s.log.Error("job %s failed after %s: %s", j.name, duration, err.Error())
+	} else {
+		opsJobLastSuccess.WithLabelValues(j.name).Set(float64(time.Now().Unix()))
+		s.log.Info("job %s finished in %s", j.name, duration)
+	}
+	opsJobRuns.WithLabelValues(j.name, outcome).Inc()
+	opsJobDuration.WithLabelValues(j.name).Observe(duration.Seconds())
+
+	db, err := s.db.DB()
+	if err != nil {
+		return
+	}
+	// the outcome is recorded even when the job was cancelled
+	recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	err = database.New(dbtx.Instrument(db)).FinishScheduledJob(recordCtx, database.FinishScheduledJobParams{
+		Name:           j.name,
+		LastOutcome:    sql.NullString{String: outcome, Valid: true},
+		LastError:      lastError,
+		LastDurationMs: sql.NullInt64{Int64: duration.Milliseconds(), Valid: true},
+	})
+	if err != nil {
+		s.log.Warn("failed to record the outcome of job %s: %s", j.name, err.Error())
+	}
+}
+
+func (s *Scheduler) job(name string) *job {
+	for _, j := range s.jobs {
+		if j.name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+// Jobs returns the state of every job as recorded by the leader.
+func (s *Scheduler) Jobs(ctx context.Context) ([]database.ScheduledJob, error) {
+	db, err := s.db.DB()
+	if err != nil {
+		return nil, err
+	}
+	return database.New(dbtx.Instrument(db)).GetScheduledJobs(ctx)
+}
@@ -0,0 +1,70 @@
+package slack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	postMessageURL = "https://slack.com/api/chat.postMessage"
+	requestTimeout = 10 * time.Second
+)
+
+type Client struct {
+	token      string
+	httpClient *http.Client
+}
+
+func New(token string) *Client {
+	return &Client{
+		token:      token,
+		httpClient: &http.Client{Timeout: requestTimeout},
+	}
+}
+
+func (c *Client) PostMessage(ctx context.Context, channelID, text string) error {
+	body, err := json.Marshal(struct {
+		Channel string `json:"channel"`
+		Text    string `json:"text"`
+	}{
+		Channel: channelID,
+		Text:    text,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, postMessageURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack responded with status %d", res.StatusCode)
+	}
+
+	var out struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return fmt.Errorf("failed to decode slack response: %w", err)
+	}
+	if !out.OK {
+		return fmt.Errorf("slack responded with error: %s", out.Error)
+	}
+
+	return nil
+}
@@ -0,0 +1,19 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id bigint PRIMARY KEY,
+    event_type text NOT NULL,
+    idempotency_key text NOT NULL UNIQUE,
+    payload jsonb NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    last_error text,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    next_attempt_at timestamptz NOT NULL DEFAULT now(),
+    delivered_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS outbox_events_pending_idx ON outbox_events (next_attempt_at)
+WHERE
+    delivered_at IS NULL;
+
+-- +goose Down
+DROP TABLE outbox_events;
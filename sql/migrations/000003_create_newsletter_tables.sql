@@ -0,0 +1,28 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS subscribers (
+    id bigint PRIMARY KEY,
+    email text NOT NULL UNIQUE,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    confirmed_at timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS newsletter_announcements (
+    article_id bigint PRIMARY KEY,
+    announced_at timestamptz NOT NULL DEFAULT now()
+);
+
+-- articles published before the newsletter existed are never announced
+INSERT INTO newsletter_announcements (article_id)
+VALUES (1417231583613554688),
+    (1428029051347406848),
+    (1428744843063988224),
+    (1458103253970456576),
+    (1463957572842164224),
+    (1523603957669171200)
+ON CONFLICT (article_id)
+    DO NOTHING;
+
+-- +goose Down
+DROP TABLE newsletter_announcements;
+
+DROP TABLE subscribers;
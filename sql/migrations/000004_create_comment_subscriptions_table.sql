@@ -0,0 +1,13 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS comment_subscriptions (
+    id bigint PRIMARY KEY,
+    article_id bigint NOT NULL,
+    username text NOT NULL,
+    email_hash bytea NOT NULL,
+    email_encrypted bytea NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    UNIQUE (article_id, email_hash)
+);
+
+-- +goose Down
+DROP TABLE comment_subscriptions;
@@ -0,0 +1,27 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS admin_webauthn_credentials (
+    id bytea PRIMARY KEY,
+    name text NOT NULL,
+    credential jsonb NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    last_used_at timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS admin_webauthn_ceremonies (
+    id bytea PRIMARY KEY,
+    session_data jsonb NOT NULL,
+    expires_at timestamptz NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS admin_recovery_codes (
+    code_hash bytea PRIMARY KEY,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    used_at timestamptz
+);
+
+-- +goose Down
+DROP TABLE admin_recovery_codes;
+
+DROP TABLE admin_webauthn_ceremonies;
+
+DROP TABLE admin_webauthn_credentials;
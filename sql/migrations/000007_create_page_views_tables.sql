@@ -0,0 +1,23 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS page_views (
+    id bigserial PRIMARY KEY,
+    path text NOT NULL,
+    article_id bigint,
+    referrer_host text,
+    user_agent_class text NOT NULL,
+    visitor_hash bytea NOT NULL,
+    viewed_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS page_views_viewed_at_idx ON page_views (viewed_at);
+CREATE INDEX IF NOT EXISTS page_views_article_id_viewed_at_idx ON page_views (article_id, viewed_at)
+WHERE article_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS analytics_salts (
+    day date PRIMARY KEY,
+    salt bytea NOT NULL
+);
+
+-- +goose Down
+DROP TABLE analytics_salts;
+DROP TABLE page_views;
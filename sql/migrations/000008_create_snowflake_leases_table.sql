@@ -0,0 +1,9 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS snowflake_leases (
+    machine_id integer PRIMARY KEY,
+    owner text NOT NULL,
+    expires_at timestamptz NOT NULL
+);
+
+-- +goose Down
+DROP TABLE snowflake_leases;
@@ -0,0 +1,15 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS scheduled_jobs (
+    name text PRIMARY KEY,
+    schedule text NOT NULL,
+    next_run_at timestamptz NOT NULL,
+    runner text,
+    last_started_at timestamptz,
+    last_finished_at timestamptz,
+    last_outcome text,
+    last_error text,
+    last_duration_ms bigint
+);
+
+-- +goose Down
+DROP TABLE scheduled_jobs;
@@ -0,0 +1,31 @@
+-- +goose Up
+-- every handler of an event is delivered to once, a retry only runs the
+-- handlers that failed
+CREATE TABLE IF NOT EXISTS outbox_deliveries (
+    event_id bigint NOT NULL REFERENCES outbox_events (id) ON DELETE CASCADE,
+    handler text NOT NULL,
+    delivered_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (event_id, handler)
+);
+
+-- events that failed too often are given up on and kept for inspection
+ALTER TABLE outbox_events
+    ADD COLUMN IF NOT EXISTS failed_at timestamptz;
+
+DROP INDEX IF EXISTS outbox_events_pending_idx;
+
+CREATE INDEX IF NOT EXISTS outbox_events_pending_idx ON outbox_events (next_attempt_at)
+WHERE
+    delivered_at IS NULL AND failed_at IS NULL;
+
+-- +goose Down
+DROP INDEX IF EXISTS outbox_events_pending_idx;
+
+CREATE INDEX IF NOT EXISTS outbox_events_pending_idx ON outbox_events (next_attempt_at)
+WHERE
+    delivered_at IS NULL;
+
+ALTER TABLE outbox_events
+    DROP COLUMN IF EXISTS failed_at;
+
+DROP TABLE outbox_deliveries;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- reply notifications are only sent once the address owner confirmed them,
+-- subscriptions made before are left unconfirmed as nobody vouched for them
+ALTER TABLE comment_subscriptions
+    ADD COLUMN IF NOT EXISTS confirmed_at timestamptz;
+
+-- +goose Down
+ALTER TABLE comment_subscriptions
+    DROP COLUMN IF EXISTS confirmed_at;
@@ -0,0 +1,22 @@
+-- name: CreateAdminSession :exec
+INSERT INTO admin_sessions (token_hash, created_at, expires_at)
+VALUES ($1, $2, $3);
+
+-- name: GetAdminSession :one
+SELECT token_hash, created_at, rotated_at, expires_at
+FROM admin_sessions
+WHERE token_hash = $1
+    AND expires_at > now();
+
+-- name: ExpireAdminSession :exec
+UPDATE admin_sessions
+SET expires_at = LEAST(expires_at, sqlc.arg(expires_at))
+WHERE token_hash = $1;
+
+-- name: DeleteAdminSession :exec
+DELETE FROM admin_sessions
+WHERE token_hash = $1;
+
+-- name: DeleteExpiredAdminSessions :execrows
+DELETE FROM admin_sessions
+WHERE expires_at <= now();
@@ -0,0 +1,58 @@
+-- name: CreateAdminWebAuthnCredential :exec
+INSERT INTO admin_webauthn_credentials (id, name, credential)
+VALUES ($1, $2, $3);
+
+-- name: GetAllAdminWebAuthnCredentials :many
+SELECT id, name, credential, created_at, last_used_at
+FROM admin_webauthn_credentials
+ORDER BY created_at;
+
+-- name: CountAdminWebAuthnCredentials :one
+SELECT count(*)
+FROM admin_webauthn_credentials;
+
+-- name: UpdateAdminWebAuthnCredentialUsage :exec
+UPDATE admin_webauthn_credentials
+SET credential = $2,
+    last_used_at = now()
+WHERE id = $1;
+
+-- name: DeleteAdminWebAuthnCredential :exec
+DELETE FROM admin_webauthn_credentials
+WHERE id = $1;
+
+-- name: CreateAdminWebAuthnCeremony :exec
+INSERT INTO admin_webauthn_ceremonies (id, session_data, expires_at)
+VALUES ($1, $2, $3);
+
+-- name: TakeAdminWebAuthnCeremony :one
+DELETE FROM admin_webauthn_ceremonies
+WHERE id = $1
+    AND expires_at > now()
+RETURNING session_data;
+
+-- name: DeleteExpiredAdminWebAuthnCeremonies :execrows
+DELETE FROM admin_webauthn_ceremonies
+WHERE expires_at <= now();
+
+-- name: CountAdminWebAuthnCeremonies :one
+SELECT count(*)
+FROM admin_webauthn_ceremonies;
+
+-- name: DeleteAllAdminRecoveryCodes :exec
+DELETE FROM admin_recovery_codes;
+
+-- name: CreateAdminRecoveryCode :exec
+INSERT INTO admin_recovery_codes (code_hash)
+VALUES ($1);
+
+-- name: UseAdminRecoveryCode :execrows
+UPDATE admin_recovery_codes
+SET used_at = now()
+WHERE code_hash = $1
+    AND used_at IS NULL;
+
+-- name: CountUnusedAdminRecoveryCodes :one
+SELECT count(*)
+FROM admin_recovery_codes
+WHERE used_at IS NULL;
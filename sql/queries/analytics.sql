@@ -0,0 +1,79 @@
+-- name: GetOrCreateAnalyticsSalt :one
+INSERT INTO analytics_salts (day, salt)
+VALUES ($1, $2)
+ON CONFLICT (day) DO UPDATE SET day = EXCLUDED.day
+RETURNING salt;
+
+-- name: DeleteAnalyticsSaltsBefore :exec
+DELETE FROM analytics_salts
+WHERE day < $1;
+
+-- name: CreatePageViews :exec
+INSERT INTO page_views (path, article_id, referrer_host, user_agent_class, visitor_hash, viewed_at)
+SELECT
+    v.path,
+    NULLIF(v.article_id, 0),
+    NULLIF(v.referrer_host, ''),
+    v.user_agent_class,
+    v.visitor_hash,
+    to_timestamp(v.viewed_at)
+FROM (
+    SELECT
+        unnest(sqlc.arg(paths)::text[]) AS path,
+        unnest(sqlc.arg(article_ids)::bigint[]) AS article_id,
+        unnest(sqlc.arg(referrer_hosts)::text[]) AS referrer_host,
+        unnest(sqlc.arg(user_agent_classes)::text[]) AS user_agent_class,
+        unnest(sqlc.arg(visitor_hashes)::bytea[]) AS visitor_hash,
+        unnest(sqlc.arg(viewed_ats)::bigint[]) AS viewed_at
+) AS v;
+
+-- name: GetPageViewTotals :one
+SELECT
+    count(*)::bigint AS views,
+    count(DISTINCT visitor_hash)::bigint AS uniques
+FROM page_views
+WHERE viewed_at >= $1;
+
+-- name: GetArticlePageViews :many
+SELECT
+    article_id::bigint AS article_id,
+    count(*)::bigint AS views,
+    count(DISTINCT visitor_hash)::bigint AS uniques
+FROM page_views
+WHERE viewed_at >= $1
+    AND article_id IS NOT NULL
+GROUP BY article_id
+ORDER BY views DESC;
+
+-- name: GetDailyPageViews :many
+SELECT
+    date_trunc('day', viewed_at AT TIME ZONE 'UTC')::date AS day,
+    count(*)::bigint AS views,
+    count(DISTINCT visitor_hash)::bigint AS uniques
+FROM page_views
+WHERE viewed_at >= sqlc.arg(since)
+    AND (sqlc.narg(article_id)::bigint IS NULL OR article_id = sqlc.narg(article_id))
+GROUP BY day
+ORDER BY day;
+
+-- name: GetTopReferrers :many
+SELECT
+    referrer_host::text AS referrer_host,
+    count(*)::bigint AS views
+FROM page_views
+WHERE viewed_at >= $1
+    AND referrer_host IS NOT NULL
+GROUP BY referrer_host
+ORDER BY views DESC
+LIMIT $2;
+
+-- name: GetPopularArticles :many
+SELECT
+    article_id::bigint AS article_id,
+    count(DISTINCT visitor_hash)::bigint AS uniques
+FROM page_views
+WHERE viewed_at >= $1
+    AND article_id IS NOT NULL
+GROUP BY article_id
+ORDER BY uniques DESC, article_id DESC
+LIMIT $2;
@@ -0,0 +1,38 @@
+-- name: CreateCommentSubscription :one
+-- the subscription stays with whoever subscribed the address first, an
+-- unconfirmed one only gets a new confirmation when the last one was
+-- requested before resend_before
+INSERT INTO comment_subscriptions (id, article_id, username, email_hash, email_encrypted)
+VALUES (sqlc.arg(id), sqlc.arg(article_id), sqlc.arg(username), sqlc.arg(email_hash), sqlc.arg(email_encrypted))
+ON CONFLICT (article_id, email_hash)
+    DO UPDATE SET
+        created_at = CASE WHEN comment_subscriptions.confirmed_at IS NULL
+            AND comment_subscriptions.created_at < sqlc.arg(resend_before) THEN
+            now()
+        ELSE
+            comment_subscriptions.created_at
+        END
+    RETURNING id, article_id, username, email_hash, email_encrypted, created_at, confirmed_at;
+
+-- name: GetCommentSubscriptionByID :one
+SELECT id, article_id, username, email_hash, email_encrypted, created_at, confirmed_at
+FROM comment_subscriptions
+WHERE id = $1;
+
+-- name: ConfirmCommentSubscription :execrows
+UPDATE comment_subscriptions
+SET confirmed_at = now()
+WHERE id = $1
+    AND confirmed_at IS NULL;
+
+-- name: GetCommentSubscriptionIDsToNotify :many
+SELECT id
+FROM comment_subscriptions
+WHERE article_id = $1
+    AND username <> $2
+    AND confirmed_at IS NOT NULL
+ORDER BY id;
+
+-- name: DeleteCommentSubscription :exec
+DELETE FROM comment_subscriptions
+WHERE id = $1;
@@ -8,3 +8,29 @@ SELECT id, article_id, username, content
 FROM comments
 WHERE article_id = $1
 ORDER BY id DESC;
+
+-- name: GetCommentByID :one
+SELECT id, article_id, username, content
+FROM comments
+WHERE id = $1;
+
+-- name: GetCommentsByArticleIDPage :many
+SELECT id, article_id, username, content
+FROM comments
+WHERE article_id = sqlc.arg(article_id)
+    AND (sqlc.arg(before)::bigint = 0 OR id < sqlc.arg(before)::bigint)
+ORDER BY id DESC
+LIMIT sqlc.arg(page_size);
+
+-- name: CountCommentsByArticleID :one
+SELECT count(*)
+FROM comments
+WHERE article_id = $1;
+
+-- name: DeleteComment :execrows
+DELETE FROM comments
+WHERE id = $1;
+
+-- name: DeleteCommentsByUsername :execrows
+DELETE FROM comments
+WHERE username = $1;
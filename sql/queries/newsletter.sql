@@ -0,0 +1,41 @@
+-- name: CreateSubscriber :one
+-- an unconfirmed address gets a new confirmation only when the last one was
+-- requested before resend_before, otherwise the request is a no-op
+INSERT INTO subscribers (id, email)
+VALUES (sqlc.arg(id), sqlc.arg(email))
+ON CONFLICT (email)
+    DO UPDATE SET
+        created_at = CASE WHEN subscribers.confirmed_at IS NULL
+            AND subscribers.created_at < sqlc.arg(resend_before) THEN
+            now()
+        ELSE
+            subscribers.created_at
+        END
+    RETURNING id, email, created_at, confirmed_at;
+
+-- name: GetSubscriberByID :one
+SELECT id, email, created_at, confirmed_at
+FROM subscribers
+WHERE id = $1;
+
+-- name: ConfirmSubscriber :execrows
+UPDATE subscribers
+SET confirmed_at = now()
+WHERE id = $1
+    AND confirmed_at IS NULL;
+
+-- name: DeleteSubscriber :exec
+DELETE FROM subscribers
+WHERE id = $1;
+
+-- name: GetAllConfirmedSubscriberIDs :many
+SELECT id
+FROM subscribers
+WHERE confirmed_at IS NOT NULL
+ORDER BY id;
+
+-- name: CreateNewsletterAnnouncement :execrows
+INSERT INTO newsletter_announcements (article_id)
+VALUES ($1)
+ON CONFLICT (article_id)
+    DO NOTHING;
@@ -0,0 +1,51 @@
+-- name: CreateOutboxEvent :exec
+INSERT INTO outbox_events (id, event_type, idempotency_key, payload)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (idempotency_key)
+    DO NOTHING;
+
+-- name: ClaimOutboxEvents :many
+UPDATE outbox_events
+SET next_attempt_at = sqlc.arg(lease_until)
+WHERE id IN (
+    SELECT id
+    FROM outbox_events
+    WHERE delivered_at IS NULL
+        AND failed_at IS NULL
+        AND next_attempt_at <= now()
+    ORDER BY id
+    LIMIT sqlc.arg(batch_size)
+    FOR UPDATE SKIP LOCKED)
+RETURNING id, event_type, idempotency_key, payload, attempts;
+
+-- name: MarkOutboxEventDelivered :exec
+UPDATE outbox_events
+SET delivered_at = now(),
+    attempts = attempts + 1,
+    last_error = NULL
+WHERE id = $1;
+
+-- name: MarkOutboxEventFailed :exec
+UPDATE outbox_events
+SET attempts = attempts + 1,
+    last_error = $2,
+    next_attempt_at = $3
+WHERE id = $1;
+
+-- name: MarkOutboxEventDead :exec
+UPDATE outbox_events
+SET attempts = attempts + 1,
+    last_error = $2,
+    failed_at = now()
+WHERE id = $1;
+
+-- name: GetOutboxDeliveries :many
+SELECT handler
+FROM outbox_deliveries
+WHERE event_id = $1;
+
+-- name: CreateOutboxDelivery :exec
+INSERT INTO outbox_deliveries (event_id, handler)
+VALUES ($1, $2)
+ON CONFLICT (event_id, handler)
+    DO NOTHING;
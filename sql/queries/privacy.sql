@@ -0,0 +1,16 @@
+-- name: DeleteCommentSubscriptionsByUsername :execrows
+DELETE FROM comment_subscriptions
+WHERE username = $1;
+
+-- name: DeleteOutboxEventsByUsername :execrows
+DELETE FROM outbox_events
+WHERE payload ->> 'username' = sqlc.arg(username)::text;
+
+-- name: DeletePageViewsBefore :execrows
+DELETE FROM page_views
+WHERE viewed_at < $1;
+
+-- name: DeleteFinishedOutboxEventsBefore :execrows
+DELETE FROM outbox_events
+WHERE delivered_at < sqlc.arg(before)
+    OR failed_at < sqlc.arg(before);
@@ -0,0 +1,39 @@
+-- name: UpsertScheduledJob :exec
+-- a changed schedule takes effect right away, otherwise the next run stays
+-- as the previous leader left it
+INSERT INTO scheduled_jobs (name, schedule, next_run_at)
+VALUES ($1, $2, $3)
+ON CONFLICT (name)
+    DO UPDATE SET
+        schedule = excluded.schedule,
+        next_run_at = excluded.next_run_at
+    WHERE
+        scheduled_jobs.schedule <> excluded.schedule;
+
+-- name: GetScheduledJobs :many
+SELECT name,
+    schedule,
+    next_run_at,
+    runner,
+    last_started_at,
+    last_finished_at,
+    last_outcome,
+    last_error,
+    last_duration_ms
+FROM scheduled_jobs
+ORDER BY name;
+
+-- name: StartScheduledJob :exec
+UPDATE scheduled_jobs
+SET next_run_at = $2,
+    runner = $3,
+    last_started_at = now()
+WHERE name = $1;
+
+-- name: FinishScheduledJob :exec
+UPDATE scheduled_jobs
+SET last_finished_at = now(),
+    last_outcome = $2,
+    last_error = $3,
+    last_duration_ms = $4
+WHERE name = $1;
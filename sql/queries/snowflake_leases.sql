@@ -0,0 +1,35 @@
+-- name: AcquireSnowflakeLease :one
+-- takes the lowest machine ID that is free, whose lease expired or that the
+-- owner held before, returns no rows when another process took it first
+INSERT INTO snowflake_leases (machine_id, owner, expires_at)
+SELECT m.id,
+    sqlc.arg(owner)::text,
+    now() + sqlc.arg(ttl_seconds)::integer * interval '1 second'
+FROM generate_series(0, sqlc.arg(max_machine_id)::integer) AS m (id)
+WHERE NOT EXISTS (
+        SELECT 1
+        FROM snowflake_leases l
+        WHERE l.machine_id = m.id
+            AND l.expires_at > now()
+            AND l.owner <> sqlc.arg(owner)::text)
+ORDER BY m.id
+LIMIT 1
+ON CONFLICT (machine_id)
+    DO UPDATE SET
+        owner = excluded.owner,
+        expires_at = excluded.expires_at
+    WHERE
+        snowflake_leases.expires_at <= now()
+        OR snowflake_leases.owner = excluded.owner
+    RETURNING machine_id;
+
+-- name: RenewSnowflakeLease :execrows
+UPDATE snowflake_leases
+SET expires_at = now() + sqlc.arg(ttl_seconds)::integer * interval '1 second'
+WHERE machine_id = sqlc.arg(machine_id)
+    AND owner = sqlc.arg(owner);
+
+-- name: ReleaseSnowflakeLease :exec
+DELETE FROM snowflake_leases
+WHERE machine_id = $1
+    AND owner = $2;
@@ -0,0 +1,12 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS comments (
+    id integer PRIMARY KEY,
+    article_id integer NOT NULL,
+    username text NOT NULL,
+    content text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS comments_article_id_idx ON comments (article_id, id);
+
+-- +goose Down
+DROP TABLE comments;
@@ -0,0 +1,36 @@
+-- name: CreateComment :one
+INSERT INTO comments (id, article_id, username, content)
+VALUES (?, ?, ?, ?)
+RETURNING id, article_id, username, content;
+
+-- name: GetAllCommentsByArticleID :many
+SELECT id, article_id, username, content
+FROM comments
+WHERE article_id = ?
+ORDER BY id DESC;
+
+-- name: GetCommentByID :one
+SELECT id, article_id, username, content
+FROM comments
+WHERE id = ?;
+
+-- name: GetCommentsByArticleIDPage :many
+SELECT id, article_id, username, content
+FROM comments
+WHERE article_id = sqlc.arg(article_id)
+    AND (CAST(sqlc.arg(before) AS INTEGER) = 0 OR id < CAST(sqlc.arg(before) AS INTEGER))
+ORDER BY id DESC
+LIMIT sqlc.arg(page_size);
+
+-- name: CountCommentsByArticleID :one
+SELECT count(*)
+FROM comments
+WHERE article_id = ?;
+
+-- name: DeleteComment :execrows
+DELETE FROM comments
+WHERE id = ?;
+
+-- name: DeleteCommentsByUsername :execrows
+DELETE FROM comments
+WHERE username = ?;
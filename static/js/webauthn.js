@@ -0,0 +1,85 @@
+(() => {
+  const toBuffer = (value) => {
+    const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+    const padded = base64 + "=".repeat((4 - (base64.length % 4)) % 4);
+    return Uint8Array.from(atob(padded), (c) => c.charCodeAt(0)).buffer;
+  };
+
+  const toBase64URL = (buffer) => {
+    let binary = "";
+    new Uint8Array(buffer).forEach((b) => (binary += String.fromCharCode(b)));
+    return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+  };
+
+  const toast = (message, statusCode) => {
+    window.dispatchEvent(
+      new CustomEvent("add-toast", { detail: { message, statusCode } }),
+    );
+  };
+
+  const post = async (url, body) => {
+    const res = await fetch(url, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: body ? JSON.stringify(body) : undefined,
+    });
+    if (!res.ok) {
+      throw new Error((await res.text()) || res.statusText);
+    }
+    return res.status === 204 ? null : res.json();
+  };
+
+  window.registerPasskey = async (name) => {
+    try {
+      const { publicKey } = await post("/admin/passkeys/register/begin");
+      publicKey.challenge = toBuffer(publicKey.challenge);
+      publicKey.user.id = toBuffer(publicKey.user.id);
+      (publicKey.excludeCredentials || []).forEach((c) => (c.id = toBuffer(c.id)));
+
+      const credential = await navigator.credentials.create({ publicKey });
+
+      await post(`/admin/passkeys/register/finish?name=${encodeURIComponent(name)}`, {
+        id: credential.id,
+        rawId: toBase64URL(credential.rawId),
+        type: credential.type,
+        response: {
+          attestationObject: toBase64URL(credential.response.attestationObject),
+          clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+          transports: credential.response.getTransports
+            ? credential.response.getTransports()
+            : [],
+        },
+      });
+      window.location.reload();
+    } catch (err) {
+      toast(`Failed to register passkey: ${err.message}`, 400);
+    }
+  };
+
+  window.loginWithPasskey = async () => {
+    try {
+      const { publicKey } = await post("/admin/login/passkey/begin");
+      publicKey.challenge = toBuffer(publicKey.challenge);
+      (publicKey.allowCredentials || []).forEach((c) => (c.id = toBuffer(c.id)));
+
+      const credential = await navigator.credentials.get({ publicKey });
+
+      const { redirect } = await post("/admin/login/passkey/finish", {
+        id: credential.id,
+        rawId: toBase64URL(credential.rawId),
+        type: credential.type,
+        response: {
+          authenticatorData: toBase64URL(credential.response.authenticatorData),
+          clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+          signature: toBase64URL(credential.response.signature),
+          userHandle: credential.response.userHandle
+            ? toBase64URL(credential.response.userHandle)
+            : null,
+        },
+      });
+      window.location.assign(redirect);
+    } catch (err) {
+      toast(`Passkey login failed: ${err.message}`, 401);
+    }
+  };
+})();
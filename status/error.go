@@ -14,6 +14,8 @@ var (
 
 	ErrCreateArticleComment  = fmt.Errorf("failed to create an article comment")
 	ErrGetAllArticleComments = fmt.Errorf("failed to get all article's comments")
+
+	ErrSubscribeToNewsletter = fmt.Errorf("failed to subscribe to the newsletter")
 )
 
 func ErrorNotFound(err error) Toast {
@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+
+	"github.com/ip812/blog/metrics"
 )
 
 type Toast struct {
@@ -16,6 +19,8 @@ func (t Toast) Error() string {
 }
 
 func AddToast(w http.ResponseWriter, t Toast) {
+	metrics.Toasts.WithLabelValues(strconv.Itoa(t.StatusCode), t.Message).Inc()
+
 	res, err := json.Marshal(struct {
 		Toast Toast `json:"add-toast"`
 	}{
@@ -7,6 +7,8 @@ import (
 
 var (
 	WarnNotNumbericID = fmt.Errorf("id should be a number")
+	WarnInvalidEmail  = fmt.Errorf("please enter a valid email address")
+	WarnNoReplyEmails = fmt.Errorf("email notifications are not available, leave the email empty")
 )
 
 func WarningStatusBadRequest(err error) Toast {
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// Memory is a CommentStore kept in memory, with the same semantics as
+// Postgres. It is meant for tests and for running without a database.
+type Memory struct {
+	mu       sync.RWMutex
+	comments map[int64]Comment
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		comments: make(map[int64]Comment),
+	}
+}
+
+func (s *Memory) Create(ctx context.Context, c Comment, inTx TxFunc) (Comment, error) {
+	// the lock is held while inTx runs, so nobody sees the comment before
+	// it is known whether it will be kept
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.comments[c.ID]; ok {
+		return Comment{}, ErrConflict
+	}
+
+	if inTx != nil {
+		if err := inTx(ctx, c); err != nil {
+			return Comment{}, err
+		}
+	}
+
+	s.comments[c.ID] = c
+	return c, nil
+}
+
+func (s *Memory) Get(ctx context.Context, id int64) (Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.comments[id]
+	if !ok {
+		return Comment{}, ErrNotFound
+	}
+	return c, nil
+}
+
+func (s *Memory) ListByArticle(ctx context.Context, articleID int64) ([]Comment, error) {
+	return s.list(articleID, 0, -1), nil
+}
+
+func (s *Memory) ListByArticlePage(ctx context.Context, articleID int64, page Page) ([]Comment, error) {
+	if page.Limit <= 0 {
+		return []Comment{}, nil
+	}
+	return s.list(articleID, page.Before, page.Limit), nil
+}
+
+func (s *Memory) CountByArticle(ctx context.Context, articleID int64) (int64, error) {
+	return int64(len(s.list(articleID, 0, -1))), nil
+}
+
+func (s *Memory) Delete(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.comments[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.comments, id)
+	return nil
+}
+
+func (s *Memory) DeleteByUsername(ctx context.Context, username string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for id, c := range s.comments {
+		if c.Username == username {
+			delete(s.comments, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// list returns the comments of an article older than before, newest first.
+// A negative limit returns all of them.
+func (s *Memory) list(articleID, before int64, limit int) []Comment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	comments := []Comment{}
+	for _, c := range s.comments {
+		if c.ArticleID == articleID && (before == 0 || c.ID < before) {
+			comments = append(comments, c)
+		}
+	}
+
+	slices.SortFunc(comments, func(a, b Comment) int {
+		switch {
+		case a.ID > b.ID:
+			return -1
+		case a.ID < b.ID:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	if limit >= 0 && len(comments) > limit {
+		comments = comments[:limit]
+	}
+	return comments
+}
@@ -0,0 +1,14 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/ip812/blog/store"
+	"github.com/ip812/blog/store/storetest"
+)
+
+func TestMemory(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.CommentStore {
+		return store.NewMemory()
+	})
+}
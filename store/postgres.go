@@ -0,0 +1,183 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtx"
+)
+
+type DBProvider interface {
+	DB() (*sql.DB, error)
+	// ReadDB may return a replica lagging behind DB.
+	ReadDB(ctx context.Context) (*sql.DB, error)
+}
+
+type txKey struct{}
+
+// Tx returns the Postgres transaction a TxFunc is running in, so it can
+// record side effects atomically with the comment. Other stores have no
+// transaction to offer.
+func Tx(ctx context.Context) (*sql.Tx, bool) {
+	tx, ok := ctx.Value(txKey{}).(*sql.Tx)
+	return tx, ok
+}
+
+// Postgres is a CommentStore backed by Postgres. Its queries are bounded by
+// dbtx.SetQueryTimeout like every other.
+type Postgres struct {
+	db DBProvider
+}
+
+func NewPostgres(db DBProvider) *Postgres {
+	return &Postgres{db: db}
+}
+
+func (s *Postgres) Create(ctx context.Context, c Comment, inTx TxFunc) (Comment, error) {
+	db, err := s.db.DB()
+	if err != nil {
+		return Comment{}, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Comment{}, err
+	}
+	defer tx.Rollback()
+
+	row, err := database.New(dbtx.Instrument(tx)).CreateComment(ctx, database.CreateCommentParams{
+		ID:        c.ID,
+		ArticleID: c.ArticleID,
+		Username:  c.Username,
+		Content:   c.Content,
+	})
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return Comment{}, ErrConflict
+	}
+	if err != nil {
+		return Comment{}, err
+	}
+
+	created := fromRow(row)
+	if inTx != nil {
+		if err := inTx(context.WithValue(ctx, txKey{}, tx), created); err != nil {
+			return Comment{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Comment{}, err
+	}
+
+	return created, nil
+}
+
+func (s *Postgres) Get(ctx context.Context, id int64) (Comment, error) {
+	db, err := s.db.ReadDB(ctx)
+	if err != nil {
+		return Comment{}, err
+	}
+
+	row, err := database.New(dbtx.Instrument(db)).GetCommentByID(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Comment{}, ErrNotFound
+	}
+	if err != nil {
+		return Comment{}, err
+	}
+
+	return fromRow(row), nil
+}
+
+func (s *Postgres) ListByArticle(ctx context.Context, articleID int64) ([]Comment, error) {
+	db, err := s.db.ReadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := database.New(dbtx.Instrument(db)).GetAllCommentsByArticleID(ctx, articleID)
+	if err != nil {
+		return nil, err
+	}
+
+	return fromRows(rows), nil
+}
+
+func (s *Postgres) ListByArticlePage(ctx context.Context, articleID int64, page Page) ([]Comment, error) {
+	if page.Limit <= 0 {
+		return []Comment{}, nil
+	}
+
+	db, err := s.db.ReadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := database.New(dbtx.Instrument(db)).GetCommentsByArticleIDPage(ctx, database.GetCommentsByArticleIDPageParams{
+		ArticleID: articleID,
+		Before:    page.Before,
+		PageSize:  int32(page.Limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fromRows(rows), nil
+}
+
+func (s *Postgres) CountByArticle(ctx context.Context, articleID int64) (int64, error) {
+	db, err := s.db.ReadDB(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return database.New(dbtx.Instrument(db)).CountCommentsByArticleID(ctx, articleID)
+}
+
+func (s *Postgres) Delete(ctx context.Context, id int64) error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	n, err := database.New(dbtx.Instrument(db)).DeleteComment(ctx, id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *Postgres) DeleteByUsername(ctx context.Context, username string) (int64, error) {
+	db, err := s.db.DB()
+	if err != nil {
+		return 0, err
+	}
+
+	return database.New(dbtx.Instrument(db)).DeleteCommentsByUsername(ctx, username)
+}
+
+func fromRow(row database.Comment) Comment {
+	return Comment{
+		ID:        row.ID,
+		ArticleID: row.ArticleID,
+		Username:  row.Username,
+		Content:   row.Content,
+	}
+}
+
+func fromRows(rows []database.Comment) []Comment {
+	comments := make([]Comment, 0, len(rows))
+	for _, row := range rows {
+		comments = append(comments, fromRow(row))
+	}
+	return comments
+}
@@ -0,0 +1,32 @@
+package store_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/ip812/blog/dbtest"
+	"github.com/ip812/blog/store"
+	"github.com/ip812/blog/store/storetest"
+)
+
+type staticDB struct {
+	db *sql.DB
+}
+
+func (s staticDB) DB() (*sql.DB, error) {
+	return s.db, nil
+}
+
+func (s staticDB) ReadDB(context.Context) (*sql.DB, error) {
+	return s.db, nil
+}
+
+func TestPostgres(t *testing.T) {
+	db := dbtest.Open(t)
+
+	storetest.Run(t, func(t *testing.T) store.CommentStore {
+		dbtest.Truncate(t, db, "comments")
+		return store.NewPostgres(staticDB{db})
+	})
+}
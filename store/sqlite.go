@@ -0,0 +1,133 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	sqlitedb "github.com/ip812/blog/database/sqlite"
+	"github.com/ip812/blog/dbtx"
+)
+
+// SQLite is a CommentStore backed by a SQLite file, for single-node
+// deployments and local development.
+type SQLite struct {
+	db *sql.DB
+}
+
+func NewSQLite(db *sql.DB) *SQLite {
+	return &SQLite{db: db}
+}
+
+func (s *SQLite) Create(ctx context.Context, c Comment, inTx TxFunc) (Comment, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Comment{}, err
+	}
+	defer tx.Rollback()
+
+	row, err := sqlitedb.New(dbtx.Instrument(tx)).CreateComment(ctx, sqlitedb.CreateCommentParams{
+		ID:        c.ID,
+		ArticleID: c.ArticleID,
+		Username:  c.Username,
+		Content:   c.Content,
+	})
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY {
+		return Comment{}, ErrConflict
+	}
+	if err != nil {
+		return Comment{}, err
+	}
+
+	created := fromSQLiteRow(row)
+	if inTx != nil {
+		if err := inTx(ctx, created); err != nil {
+			return Comment{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Comment{}, err
+	}
+
+	return created, nil
+}
+
+func (s *SQLite) Get(ctx context.Context, id int64) (Comment, error) {
+	row, err := sqlitedb.New(dbtx.Instrument(s.db)).GetCommentByID(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Comment{}, ErrNotFound
+	}
+	if err != nil {
+		return Comment{}, err
+	}
+
+	return fromSQLiteRow(row), nil
+}
+
+func (s *SQLite) ListByArticle(ctx context.Context, articleID int64) ([]Comment, error) {
+	rows, err := sqlitedb.New(dbtx.Instrument(s.db)).GetAllCommentsByArticleID(ctx, articleID)
+	if err != nil {
+		return nil, err
+	}
+
+	return fromSQLiteRows(rows), nil
+}
+
+func (s *SQLite) ListByArticlePage(ctx context.Context, articleID int64, page Page) ([]Comment, error) {
+	if page.Limit <= 0 {
+		return []Comment{}, nil
+	}
+
+	rows, err := sqlitedb.New(dbtx.Instrument(s.db)).GetCommentsByArticleIDPage(ctx, sqlitedb.GetCommentsByArticleIDPageParams{
+		ArticleID: articleID,
+		Before:    page.Before,
+		PageSize:  int64(page.Limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fromSQLiteRows(rows), nil
+}
+
+func (s *SQLite) CountByArticle(ctx context.Context, articleID int64) (int64, error) {
+	return sqlitedb.New(dbtx.Instrument(s.db)).CountCommentsByArticleID(ctx, articleID)
+}
+
+func (s *SQLite) Delete(ctx context.Context, id int64) error {
+	n, err := sqlitedb.New(dbtx.Instrument(s.db)).DeleteComment(ctx, id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *SQLite) DeleteByUsername(ctx context.Context, username string) (int64, error) {
+	return sqlitedb.New(dbtx.Instrument(s.db)).DeleteCommentsByUsername(ctx, username)
+}
+
+func fromSQLiteRow(row sqlitedb.Comment) Comment {
+	return Comment{
+		ID:        row.ID,
+		ArticleID: row.ArticleID,
+		Username:  row.Username,
+		Content:   row.Content,
+	}
+}
+
+func fromSQLiteRows(rows []sqlitedb.Comment) []Comment {
+	comments := make([]Comment, 0, len(rows))
+	for _, row := range rows {
+		comments = append(comments, fromSQLiteRow(row))
+	}
+	return comments
+}
@@ -0,0 +1,35 @@
+package store_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pressly/goose/v3"
+	_ "modernc.org/sqlite"
+
+	"github.com/ip812/blog/store"
+	"github.com/ip812/blog/store/storetest"
+)
+
+func TestSQLite(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.CommentStore {
+		db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "blog.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		provider, err := goose.NewProvider(goose.DialectSQLite3, db, os.DirFS("../sql/sqlite/migrations"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := provider.Up(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		return store.NewSQLite(db)
+	})
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrNotFound = errors.New("comment not found")
+	ErrConflict = errors.New("comment already exists")
+)
+
+type Comment struct {
+	ID        int64
+	ArticleID int64
+	Username  string
+	Content   string
+}
+
+// Page selects a slice of an article's comments, newest first. Before is the
+// ID of the last comment of the previous page, zero for the first page.
+type Page struct {
+	Before int64
+	Limit  int
+}
+
+// TxFunc runs while a comment is being created, before it is visible to
+// others. Returning an error discards the comment.
+type TxFunc func(ctx context.Context, c Comment) error
+
+// CommentStore keeps the comments of articles. Comment IDs are chosen by the
+// caller and are expected to grow over time, so ordering by ID is ordering
+// by age.
+type CommentStore interface {
+	Create(ctx context.Context, c Comment, inTx TxFunc) (Comment, error)
+	Get(ctx context.Context, id int64) (Comment, error)
+	ListByArticle(ctx context.Context, articleID int64) ([]Comment, error)
+	ListByArticlePage(ctx context.Context, articleID int64, page Page) ([]Comment, error)
+	CountByArticle(ctx context.Context, articleID int64) (int64, error)
+	Delete(ctx context.Context, id int64) error
+	// DeleteByUsername deletes every comment of a user and returns how many
+	// there were.
+	DeleteByUsername(ctx context.Context, username string) (int64, error)
+}
@@ -0,0 +1,238 @@
+// Package storetest checks that a store.CommentStore behaves like the
+// others. Every implementation is expected to pass Run, e.g.
+//
+//	func TestMemory(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) store.CommentStore {
+//			return store.NewMemory()
+//		})
+//	}
+package storetest
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/ip812/blog/store"
+)
+
+// Run runs the conformance suite. newStore must return an empty store for
+// every call.
+func Run(t *testing.T, newStore func(t *testing.T) store.CommentStore) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s store.CommentStore)
+	}{
+		{"CreateAndGet", testCreateAndGet},
+		{"CreateConflict", testCreateConflict},
+		{"CreateRollback", testCreateRollback},
+		{"GetMissing", testGetMissing},
+		{"ListByArticle", testListByArticle},
+		{"ListByArticlePage", testListByArticlePage},
+		{"CountByArticle", testCountByArticle},
+		{"Delete", testDelete},
+		{"DeleteByUsername", testDeleteByUsername},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t))
+		})
+	}
+}
+
+func testCreateAndGet(t *testing.T, s store.CommentStore) {
+	ctx := context.Background()
+	want := store.Comment{ID: 1, ArticleID: 10, Username: "user", Content: "hello"}
+
+	got, err := s.Create(ctx, want, nil)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if got != want {
+		t.Fatalf("Create returned %+v, want %+v", got, want)
+	}
+
+	got, err = s.Get(ctx, want.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got != want {
+		t.Fatalf("Get returned %+v, want %+v", got, want)
+	}
+}
+
+func testCreateConflict(t *testing.T, s store.CommentStore) {
+	ctx := context.Background()
+	c := store.Comment{ID: 1, ArticleID: 10, Username: "user", Content: "hello"}
+
+	mustCreate(t, s, c)
+	if _, err := s.Create(ctx, c, nil); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("Create of a duplicate returned %v, want %v", err, store.ErrConflict)
+	}
+}
+
+func testCreateRollback(t *testing.T, s store.CommentStore) {
+	ctx := context.Background()
+	c := store.Comment{ID: 1, ArticleID: 10, Username: "user", Content: "hello"}
+	errHook := errors.New("hook failed")
+
+	var called bool
+	_, err := s.Create(ctx, c, func(ctx context.Context, got store.Comment) error {
+		called = true
+		if got != c {
+			t.Errorf("TxFunc got %+v, want %+v", got, c)
+		}
+		return errHook
+	})
+	if !called {
+		t.Fatal("TxFunc was not called")
+	}
+	if !errors.Is(err, errHook) {
+		t.Fatalf("Create returned %v, want %v", err, errHook)
+	}
+
+	if _, err := s.Get(ctx, c.ID); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("Get after a failed TxFunc returned %v, want %v", err, store.ErrNotFound)
+	}
+}
+
+func testGetMissing(t *testing.T, s store.CommentStore) {
+	if _, err := s.Get(context.Background(), 42); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("Get returned %v, want %v", err, store.ErrNotFound)
+	}
+}
+
+func testListByArticle(t *testing.T, s store.CommentStore) {
+	ctx := context.Background()
+
+	got, err := s.ListByArticle(ctx, 10)
+	if err != nil {
+		t.Fatalf("ListByArticle: %v", err)
+	}
+	if got == nil || len(got) != 0 {
+		t.Fatalf("ListByArticle of an empty store returned %#v, want an empty slice", got)
+	}
+
+	mustCreate(t, s, store.Comment{ID: 1, ArticleID: 10, Username: "a", Content: "first"})
+	mustCreate(t, s, store.Comment{ID: 3, ArticleID: 10, Username: "b", Content: "third"})
+	mustCreate(t, s, store.Comment{ID: 2, ArticleID: 20, Username: "c", Content: "other"})
+
+	got, err = s.ListByArticle(ctx, 10)
+	if err != nil {
+		t.Fatalf("ListByArticle: %v", err)
+	}
+	assertIDs(t, got, 3, 1)
+}
+
+func testListByArticlePage(t *testing.T, s store.CommentStore) {
+	ctx := context.Background()
+	for id := int64(1); id <= 5; id++ {
+		mustCreate(t, s, store.Comment{ID: id, ArticleID: 10, Username: "a", Content: "c"})
+	}
+	mustCreate(t, s, store.Comment{ID: 6, ArticleID: 20, Username: "a", Content: "c"})
+
+	first, err := s.ListByArticlePage(ctx, 10, store.Page{Limit: 2})
+	if err != nil {
+		t.Fatalf("ListByArticlePage: %v", err)
+	}
+	assertIDs(t, first, 5, 4)
+
+	second, err := s.ListByArticlePage(ctx, 10, store.Page{Before: first[len(first)-1].ID, Limit: 2})
+	if err != nil {
+		t.Fatalf("ListByArticlePage: %v", err)
+	}
+	assertIDs(t, second, 3, 2)
+
+	last, err := s.ListByArticlePage(ctx, 10, store.Page{Before: 2, Limit: 2})
+	if err != nil {
+		t.Fatalf("ListByArticlePage: %v", err)
+	}
+	assertIDs(t, last, 1)
+
+	none, err := s.ListByArticlePage(ctx, 10, store.Page{Limit: 0})
+	if err != nil {
+		t.Fatalf("ListByArticlePage: %v", err)
+	}
+	assertIDs(t, none)
+}
+
+func testCountByArticle(t *testing.T, s store.CommentStore) {
+	ctx := context.Background()
+	mustCreate(t, s, store.Comment{ID: 1, ArticleID: 10, Username: "a", Content: "c"})
+	mustCreate(t, s, store.Comment{ID: 2, ArticleID: 10, Username: "a", Content: "c"})
+	mustCreate(t, s, store.Comment{ID: 3, ArticleID: 20, Username: "a", Content: "c"})
+
+	for articleID, want := range map[int64]int64{10: 2, 20: 1, 30: 0} {
+		got, err := s.CountByArticle(ctx, articleID)
+		if err != nil {
+			t.Fatalf("CountByArticle: %v", err)
+		}
+		if got != want {
+			t.Errorf("CountByArticle(%d) = %d, want %d", articleID, got, want)
+		}
+	}
+}
+
+func testDelete(t *testing.T, s store.CommentStore) {
+	ctx := context.Background()
+	mustCreate(t, s, store.Comment{ID: 1, ArticleID: 10, Username: "a", Content: "c"})
+	mustCreate(t, s, store.Comment{ID: 2, ArticleID: 10, Username: "a", Content: "c"})
+
+	if err := s.Delete(ctx, 1); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := s.Delete(ctx, 1); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("second Delete returned %v, want %v", err, store.ErrNotFound)
+	}
+
+	got, err := s.ListByArticle(ctx, 10)
+	if err != nil {
+		t.Fatalf("ListByArticle: %v", err)
+	}
+	assertIDs(t, got, 2)
+}
+
+func testDeleteByUsername(t *testing.T, s store.CommentStore) {
+	ctx := context.Background()
+	mustCreate(t, s, store.Comment{ID: 1, ArticleID: 10, Username: "a", Content: "c"})
+	mustCreate(t, s, store.Comment{ID: 2, ArticleID: 20, Username: "a", Content: "c"})
+	mustCreate(t, s, store.Comment{ID: 3, ArticleID: 10, Username: "b", Content: "c"})
+
+	n, err := s.DeleteByUsername(ctx, "a")
+	if err != nil {
+		t.Fatalf("DeleteByUsername: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("DeleteByUsername deleted %d comments, want 2", n)
+	}
+
+	got, err := s.ListByArticle(ctx, 10)
+	if err != nil {
+		t.Fatalf("ListByArticle: %v", err)
+	}
+	assertIDs(t, got, 3)
+
+	if n, err := s.DeleteByUsername(ctx, "a"); err != nil || n != 0 {
+		t.Fatalf("second DeleteByUsername returned %d, %v, want 0, nil", n, err)
+	}
+}
+
+func mustCreate(t *testing.T, s store.CommentStore, c store.Comment) {
+	t.Helper()
+	if _, err := s.Create(context.Background(), c, nil); err != nil {
+		t.Fatalf("Create(%+v): %v", c, err)
+	}
+}
+
+func assertIDs(t *testing.T, comments []store.Comment, want ...int64) {
+	t.Helper()
+	got := make([]int64, 0, len(comments))
+	for _, c := range comments {
+		got = append(got, c.ID)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got comment IDs %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,232 @@
+package suggestions
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ip812/blog/articles"
+	"github.com/ip812/blog/database"
+	"github.com/ip812/blog/dbtx"
+	"github.com/ip812/blog/logger"
+)
+
+const (
+	relatedLimit    = 3
+	popularLimit    = 5
+	popularWindow   = 30 * 24 * time.Hour
+	refreshInterval = 15 * time.Minute
+
+	// tags are picked by hand, so an overlap counts as much as the whole
+	// text similarity
+	tagWeight  = 0.5
+	textWeight = 0.5
+)
+
+var (
+	tagPattern   = regexp.MustCompile(`(?s)<script.*?</script>|<style.*?</style>|<[^>]*>`)
+	tokenPattern = regexp.MustCompile(`[a-z0-9]+`)
+)
+
+type DBProvider interface {
+	ReadDB(ctx context.Context) (*sql.DB, error)
+}
+
+// Service answers which articles to read next. Related articles depend only
+// on the article texts and are computed once, popular ones are reloaded from
+// the recorded page views every refreshInterval.
+type Service struct {
+	db  DBProvider
+	log logger.Logger
+
+	related map[uint64][]articles.ArticleMetadata
+
+	mu      sync.RWMutex
+	popular []articles.ArticleMetadata
+}
+
+// New builds the related articles index from the rendered HTML of every
+// article, keyed by article ID.
+func New(db DBProvider, log logger.Logger, pages map[uint64]string) *Service {
+	return &Service{
+		db:      db,
+		log:     log,
+		related: relatedArticles(pages),
+	}
+}
+
+func (s *Service) Related(id uint64) []articles.ArticleMetadata {
+	return s.related[id]
+}
+
+// Popular returns the most read articles of the last month, leaving out the
+// one being read.
+func (s *Service) Popular(excludeID uint64) []articles.ArticleMetadata {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	popular := make([]articles.ArticleMetadata, 0, len(s.popular))
+	for _, m := range s.popular {
+		if m.ID != excludeID && len(popular) < popularLimit {
+			popular = append(popular, m)
+		}
+	}
+	return popular
+}
+
+// Run refreshes the popular articles until ctx is cancelled.
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.refresh(ctx); err != nil {
+			s.log.Warn("failed to refresh popular articles: %s", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) refresh(ctx context.Context) error {
+	db, err := s.db.ReadDB(ctx)
+	if err != nil {
+		return err
+	}
+
+	rows, err := database.New(dbtx.Instrument(db)).GetPopularArticles(ctx, database.GetPopularArticlesParams{
+		ViewedAt: time.Now().UTC().Add(-popularWindow),
+		// one extra, in case the article being read is among them
+		Limit: popularLimit + 1,
+	})
+	if err != nil {
+		return err
+	}
+
+	popular := make([]articles.ArticleMetadata, 0, len(rows))
+	for _, row := range rows {
+		if m := articles.GetByID(uint64(row.ArticleID)); m != nil {
+			popular = append(popular, *m)
+		}
+	}
+
+	s.mu.Lock()
+	s.popular = popular
+	s.mu.Unlock()
+
+	return nil
+}
+
+// relatedArticles scores every pair of articles by tag overlap (Jaccard) and
+// by cosine similarity of their TF-IDF weighted words.
+func relatedArticles(pages map[uint64]string) map[uint64][]articles.ArticleMetadata {
+	vectors := tfidf(pages)
+
+	related := make(map[uint64][]articles.ArticleMetadata, len(articles.Metadata))
+	for _, a := range articles.Metadata {
+		type scored struct {
+			meta  articles.ArticleMetadata
+			score float64
+		}
+
+		var candidates []scored
+		for _, b := range articles.Metadata {
+			if a.ID == b.ID {
+				continue
+			}
+			score := tagWeight*jaccard(a.Tags, b.Tags) + textWeight*cosine(vectors[a.ID], vectors[b.ID])
+			if score > 0 {
+				candidates = append(candidates, scored{meta: b, score: score})
+			}
+		}
+
+		slices.SortStableFunc(candidates, func(x, y scored) int {
+			switch {
+			case x.score > y.score:
+				return -1
+			case x.score < y.score:
+				return 1
+			default:
+				return 0
+			}
+		})
+
+		for i := 0; i < len(candidates) && i < relatedLimit; i++ {
+			related[a.ID] = append(related[a.ID], candidates[i].meta)
+		}
+	}
+
+	return related
+}
+
+func tfidf(pages map[uint64]string) map[uint64]map[string]float64 {
+	counts := make(map[uint64]map[string]int, len(pages))
+	docFreq := make(map[string]int)
+	for id, page := range pages {
+		text := strings.ToLower(tagPattern.ReplaceAllString(page, " "))
+		tf := make(map[string]int)
+		for _, token := range tokenPattern.FindAllString(text, -1) {
+			if len(token) < 3 {
+				continue
+			}
+			if tf[token] == 0 {
+				docFreq[token]++
+			}
+			tf[token]++
+		}
+		counts[id] = tf
+	}
+
+	vectors := make(map[uint64]map[string]float64, len(counts))
+	for id, tf := range counts {
+		vec := make(map[string]float64, len(tf))
+		for token, n := range tf {
+			// words found on every page, like the layout, weigh nothing
+			idf := math.Log(float64(len(pages)) / float64(docFreq[token]))
+			if idf > 0 {
+				vec[token] = (1 + math.Log(float64(n))) * idf
+			}
+		}
+		vectors[id] = vec
+	}
+
+	return vectors
+}
+
+func cosine(a, b map[string]float64) float64 {
+	var dot, normA, normB float64
+	for token, wa := range a {
+		dot += wa * b[token]
+		normA += wa * wa
+	}
+	for _, wb := range b {
+		normB += wb * wb
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+func jaccard(a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	var shared int
+	for _, tag := range a {
+		if slices.Contains(b, tag) {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
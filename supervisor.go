@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ip812/blog/config"
+	"github.com/ip812/blog/logger"
+)
+
+const (
+	supervisorInterval    = 30 * time.Second
+	replicaCheckInterval  = 5 * time.Second
+	supervisorPingTimeout = 5 * time.Second
+	// a pool is replaced only after this many health checks in a row failed,
+	// so a single slow ping doesn't throw away working connections
+	supervisorMaxFailures = 3
+	// holders of the old pool get this long to start their queries before
+	// the pool stops accepting new ones
+	drainGracePeriod = 5 * time.Second
+	drainTimeout     = 1 * time.Minute
+	// a reconnect gives up after this long and is tried again on the next
+	// failed checks, with the current pool kept in the meantime
+	reconnectTimeout = 2 * time.Minute
+)
+
+// DBSupervisor keeps the pool in SwappableDB healthy. It periodically pings
+// the database and reconnects after sustained failures or when the DSN
+// changes, i.e. when the password in DB_PASSWORD_FILE was rotated (the
+// environment doesn't change while the process runs). The new pool is
+// swapped in and the old one closed once its in-flight queries are done.
+type DBSupervisor struct {
+	db  *SwappableDB
+	cfg *config.Config
+	log logger.Logger
+
+	mu      sync.Mutex
+	current dbConnection
+	// failures is only touched by the Run loop
+	failures     int
+	reconnecting atomic.Bool
+	// background tracks reconnects and drains, which Close waits for
+	background sync.WaitGroup
+}
+
+func NewDBSupervisor(db *SwappableDB, conn dbConnection, cfg *config.Config, log logger.Logger) *DBSupervisor {
+	return &DBSupervisor{
+		db:      db,
+		cfg:     cfg,
+		log:     log,
+		current: conn,
+	}
+}
+
+func (s *DBSupervisor) Run(ctx context.Context) {
+	ticker := time.NewTicker(supervisorInterval)
+	defer ticker.Stop()
+	// replicas are checked more often, reads fail over to the primary as
+	// soon as one of them is found to be down
+	replicaTicker := time.NewTicker(replicaCheckInterval)
+	defer replicaTicker.Stop()
+
+	s.checkReplicas(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.check(ctx)
+		case <-replicaTicker.C:
+			s.checkReplicas(ctx)
+		}
+	}
+}
+
+// Close waits for reconnects and pools being drained and closes the current
+// one and the replicas. The context given to Run must be cancelled first.
+func (s *DBSupervisor) Close() error {
+	s.background.Wait()
+
+	for _, r := range s.db.SetReplicas(nil) {
+		if err := r.conn.Close(); err != nil {
+			s.log.Warn("failed to close read replica %s: %s", r.endpoint, err.Error())
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current.Close()
+}
+
+func (s *DBSupervisor) check(ctx context.Context) {
+	if s.reconnecting.Load() {
+		return
+	}
+
+	s.mu.Lock()
+	current := s.current
+	s.mu.Unlock()
+
+	dsn, err := s.cfg.DatabaseURL(s.cfg.Database.Endpoint)
+	if err != nil {
+		s.log.Warn("failed to build the database settings: %s", err.Error())
+	} else if dsn != current.dsn {
+		s.log.Info("database settings changed, reconnecting")
+		s.startReconnect(ctx)
+		return
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, supervisorPingTimeout)
+	defer cancel()
+
+	if err := current.db.PingContext(pingCtx); err != nil {
+		s.failures++
+		s.log.Warn("database health check failed (%d/%d): %s", s.failures, supervisorMaxFailures, err.Error())
+		if s.failures >= supervisorMaxFailures {
+			s.startReconnect(ctx)
+		}
+		return
+	}
+	s.failures = 0
+}
+
+// startReconnect reconnects in the background, so the replicas are still
+// checked while the primary is retried. Checks of the primary are skipped
+// until it is done.
+func (s *DBSupervisor) startReconnect(ctx context.Context) {
+	s.failures = 0
+	s.reconnecting.Store(true)
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		defer s.reconnecting.Store(false)
+		s.reconnect(ctx)
+	}()
+}
+
+// checkReplicas pings every replica and replaces its pool after sustained
+// failures or when its DSN changed, the same as check does for the primary.
+// A new pool is swapped in only once it answered a ping, so a replica that
+// stays down is retried every supervisorMaxFailures checks.
+func (s *DBSupervisor) checkReplicas(ctx context.Context) {
+	for _, r := range s.db.Replicas() {
+		dsn, err := s.cfg.DatabaseURL(r.endpoint)
+		if err != nil {
+			s.log.Warn("failed to build the settings of read replica %s: %s", r.endpoint, err.Error())
+		} else if dsn != r.conn.dsn {
+			s.log.Info("settings of read replica %s changed, reconnecting", r.endpoint)
+			s.reconnectReplica(ctx, r, dsn)
+			continue
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, supervisorPingTimeout)
+		err = r.conn.db.PingContext(pingCtx)
+		cancel()
+
+		healthy := err == nil
+		if healthy {
+			r.failures = 0
+		} else if r.failures++; r.failures >= supervisorMaxFailures && dsn != "" {
+			r.failures = 0
+			s.reconnectReplica(ctx, r, dsn)
+		}
+
+		if r.healthy.Swap(healthy) == healthy {
+			continue
+		}
+		if healthy {
+			s.log.Info("read replica %s is healthy", r.endpoint)
+		} else {
+			s.log.Warn("read replica %s is down, reading from the primary: %s", r.endpoint, err.Error())
+		}
+	}
+}
+
+func (s *DBSupervisor) reconnectReplica(ctx context.Context, r *replica, dsn string) {
+	conn, err := openDatabase(s.cfg, dsn)
+	if err != nil {
+		s.log.Warn("failed to reconnect to read replica %s: %s", r.endpoint, err.Error())
+		return
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, supervisorPingTimeout)
+	defer cancel()
+	if err := conn.db.PingContext(pingCtx); err != nil {
+		conn.Close()
+		s.log.Warn("failed to reconnect to read replica %s: %s", r.endpoint, err.Error())
+		return
+	}
+
+	fresh := &replica{endpoint: r.endpoint, conn: conn}
+	fresh.healthy.Store(true)
+	if !s.db.ReplaceReplica(r, fresh) {
+		conn.Close()
+		return
+	}
+	if !r.healthy.Load() {
+		s.log.Info("read replica %s is healthy", r.endpoint)
+	}
+	s.log.Info("swapped in a new pool for read replica %s", r.endpoint)
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.drain(r.conn)
+	}()
+}
+
+func (s *DBSupervisor) reconnect(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, reconnectTimeout)
+	defer cancel()
+
+	conn, err := connectToDatabaseWithRetry(ctx, s.cfg, s.log)
+	if err != nil {
+		s.log.Error("failed to reconnect to the database, keeping the current pool: %s", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	old := s.current
+	s.current = conn
+	s.mu.Unlock()
+
+	s.db.Swap(conn.db)
+	s.log.Info("swapped in a new database pool")
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.drain(old)
+	}()
+}
+
+// drain closes a pool that is no longer handed out. Requests that fetched it
+// just before the swap may still be about to use it, so it is closed only
+// after a grace period and once no connection is in use, or after
+// drainTimeout at the latest.
+func (s *DBSupervisor) drain(conn dbConnection) {
+	time.Sleep(drainGracePeriod)
+
+	deadline := time.Now().Add(drainTimeout)
+	for conn.db.Stats().InUse > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := conn.Close(); err != nil {
+		s.log.Warn("failed to close the old database pool: %s", err.Error())
+		return
+	}
+	s.log.Info("closed the old database pool")
+}
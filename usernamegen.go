@@ -5,16 +5,39 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/godruoyi/go-snowflake"
+	"github.com/ip812/blog/idgen"
+	"github.com/ip812/blog/secure"
 )
 
 const (
 	CookieKey        = "IP812_BLOG_USERNAME"
 	DefaultAvatarURL = "https://avatars.githubusercontent.com/u/2878733?v=4"
+	usernamePurpose  = "username"
 )
 
-func generateUsername() string {
-	return "user_" + strconv.FormatUint(snowflake.ID(), 10)
+func generateUsername() (string, error) {
+	id, err := idgen.NextID()
+	if err != nil {
+		return "", err
+	}
+	return "user_" + strconv.FormatInt(id, 10), nil
+}
+
+// signUsername returns the value of the username cookie, the username and
+// its signature. Usernames are shown next to every comment, without the
+// signature anyone could claim one, e.g. to erase its comments.
+func signUsername(key, username string) string {
+	return username + "." + secure.Sign(key, usernamePurpose, username)
+}
+
+// verifyUsername returns the username of a cookie value made by
+// signUsername, false for unsigned or tampered values.
+func verifyUsername(key, value string) (string, bool) {
+	username, signature, ok := strings.Cut(value, ".")
+	if !ok || !secure.Verify(key, signature, usernamePurpose, username) {
+		return "", false
+	}
+	return username, true
 }
 
 func getAvatarURL(username string) string {
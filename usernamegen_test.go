@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestSignedUsername(t *testing.T) {
+	const key = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	value := signUsername(key, "user_123")
+
+	if username, ok := verifyUsername(key, value); !ok || username != "user_123" {
+		t.Errorf("verifyUsername(%q) = %q, %t, want user_123", value, username, ok)
+	}
+
+	for _, forged := range []string{
+		"user_123",
+		"user_123.",
+		"user_124" + value[len("user_123"):],
+		value + "x",
+		signUsername("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "user_123"),
+	} {
+		if _, ok := verifyUsername(key, forged); ok {
+			t.Errorf("verifyUsername(%q) accepted a forged cookie", forged)
+		}
+	}
+}
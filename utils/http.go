@@ -6,14 +6,38 @@ import (
 	"net/http"
 
 	"github.com/a-h/templ"
+	"github.com/go-chi/chi/v5"
+	"github.com/ip812/blog/metrics"
 	"github.com/ip812/blog/status"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func Render(w http.ResponseWriter, r *http.Request, c templ.Component) error {
+var tracer = otel.Tracer("github.com/ip812/blog/utils")
+
+// Render writes c in a span named after the component, e.g. "render
+// views.LandingPage" for Render(w, r, "views.LandingPage", views.LandingPage()).
+// templ components are closures, so name can't be taken from c itself.
+func Render(w http.ResponseWriter, r *http.Request, name string, c templ.Component) error {
 	w.Header().Set("Content-Type", "text/html")
 
-	err := c.Render(r.Context(), w)
-	if err != nil {
+	route := "unmatched"
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		route = rctx.RoutePattern()
+	}
+
+	ctx, span := tracer.Start(r.Context(), "render "+name, trace.WithAttributes(
+		attribute.String("http.route", route),
+		attribute.String("templ.component", name),
+	))
+	defer span.End()
+
+	if err := c.Render(ctx, w); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		metrics.RenderFailures.WithLabelValues(route).Inc()
 		return status.ErrorInternalServerError(fmt.Errorf("server failed to render this component"))
 	}
 
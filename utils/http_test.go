@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/a-h/templ"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRenderSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	c := templ.ComponentFunc(func(ctx context.Context, w io.Writer) error {
+		_, err := io.WriteString(w, "<p>hello</p>")
+		return err
+	})
+	w := httptest.NewRecorder()
+	if err := Render(w, httptest.NewRequest(http.MethodGet, "/", nil), "views.LandingPage", c); err != nil {
+		t.Fatal(err)
+	}
+	if w.Body.String() != "<p>hello</p>" {
+		t.Errorf("body = %q, want the component", w.Body.String())
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(spans))
+	}
+	if name := spans[0].Name(); name != "render views.LandingPage" {
+		t.Errorf("span name = %q, want %q", name, "render views.LandingPage")
+	}
+	want := attribute.String("templ.component", "views.LandingPage")
+	found := false
+	for _, attr := range spans[0].Attributes() {
+		if attr == want {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("attributes = %v, want %v", spans[0].Attributes(), want)
+	}
+}